@@ -2,28 +2,79 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"io"
 	"net/http"
 	"time"
+
+	"sanctum/middleware"
 )
 
+const TOKEN_LIFETIME = 24 * time.Hour
+
+// A user keeps their cards and decks for as long as they keep renewing
+// within this long of their last renewal
+const REFRESH_TOKEN_LIFETIME = 90 * 24 * time.Hour
+
+type AuthRequest struct {
+	RefreshToken string `json:"refreshToken,omitempty"`
+}
+
+func signToken(claims jwt.MapClaims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(middleware.JwtKey())
+}
+
+// AuthHandler issues an access token and a refresh token. There are no
+// accounts yet, so a request without a refresh token gets a new user; one
+// with a refresh token gets new tokens for the user it was issued to, which
+// is how a client keeps its cards once its access token expires.
 func AuthHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["exp"] = time.Now().Add(24 * time.Hour).Unix()
+	var req AuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	sub := uuid.New().String()
+	if req.RefreshToken != "" {
+		var err error
+		sub, err = middleware.RefreshSubject(req.RefreshToken)
+		if err != nil {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+	}
 
-	tokenString, err := token.SignedString([]byte("your_secret_key"))
+	now := time.Now()
+	tokenString, err := signToken(jwt.MapClaims{
+		"sub": sub,
+		"exp": now.Add(TOKEN_LIFETIME).Unix(),
+	})
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	refreshString, err := signToken(jwt.MapClaims{
+		"sub": sub,
+		"use": middleware.TOKEN_USE_REFRESH,
+		"exp": now.Add(REFRESH_TOKEN_LIFETIME).Unix(),
+	})
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": tokenString,
+	json.NewEncoder(w).Encode(map[string]any{
+		"token":        tokenString,
+		"refreshToken": refreshString,
+		"expiresAt":    now.Add(TOKEN_LIFETIME).Unix(),
 	})
 }
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"sanctum/utils"
+)
+
+type CalibrationLabelsRequest struct {
+	Labels []utils.LabelledGrade `json:"labels"`
+}
+
+type SetCalibrationRequest struct {
+	Uuid          string  `json:"uuid,omitempty"`
+	Deck          string  `json:"deck,omitempty"`
+	Low           float32 `json:"low"`
+	PassThreshold float32 `json:"passThreshold"`
+	High          float32 `json:"high"`
+}
+
+// CalibrationHandler returns the calibration that applies to a card (GET with
+// uuid and deck query parameters) or sets one explicitly (POST)
+func CalibrationHandler(w http.ResponseWriter, r *http.Request) {
+	cs, err := utils.GetCalibrationStore()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error opening calibration store")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		calibration, scope := cs.Lookup(r.URL.Query().Get("uuid"), r.URL.Query().Get("deck"))
+		if scope == "" {
+			scope = "builtin"
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]any{
+			"scope":       scope,
+			"calibration": calibration,
+		})
+
+	case http.MethodPost:
+		var req SetCalibrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+
+		scope := utils.DEFAULT_SCOPE
+		if req.Uuid != "" {
+			scope = utils.CardScope(req.Uuid)
+		} else if req.Deck != "" {
+			scope = utils.DeckScope(req.Deck)
+		}
+
+		calibration := utils.Calibration{
+			Low:           req.Low,
+			PassThreshold: req.PassThreshold,
+			High:          req.High,
+		}
+
+		if !calibration.Valid() {
+			respondWithError(w, http.StatusBadRequest, "Calibration thresholds must satisfy low < passThreshold < high")
+			return
+		}
+
+		if err := cs.Set(scope, calibration); err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error saving calibration: %v", err))
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, map[string]string{"message": "Calibration saved", "scope": scope})
+
+	default:
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// CalibrationLabelsHandler records reviewed grades (the raw cosine grade and
+// whether a human judged the answer a pass) and re-learns thresholds from them
+func CalibrationLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req CalibrationLabelsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	for i, label := range req.Labels {
+		if label.Uuid == "" {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Label %d is missing a card uuid", i))
+			return
+		}
+	}
+
+	cs, err := utils.GetCalibrationStore()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error opening calibration store")
+		return
+	}
+
+	updated, err := cs.Record(req.Labels)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error recording labels: %v", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]any{
+		"recorded": len(req.Labels),
+		"updated":  updated,
+	})
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"sanctum/prompts"
+	"sanctum/sse"
+	"sanctum/utils"
+)
+
+var errTooFewIndexed = fmt.Errorf("deck needs at least %d indexed cards for a coverage report", utils.MIN_COVERAGE_CARDS)
+
+type FillGapsRequest struct {
+	// The subtopics to fill, as returned by /decks/{id}/coverage. When left
+	// out, the coverage is worked out again and all of its gaps are filled.
+	Subtopics     []utils.SubtopicCoverage `json:"subtopics,omitempty"`
+	CardType      utils.CardType           `json:"cardType,omitempty"`
+	PromptVersion string                   `json:"promptVersion,omitempty"`
+}
+
+// deckCoverage clusters the deck's indexed cards, labels the clusters and
+// compares the cards with the deck's outline, resized to the deck so each
+// subtopic's share can be compared with its cards. A deck without one gets
+// an outline generated from its title, which is kept so later reports are
+// compared with the same subtopics.
+func deckCoverage(deck utils.FlashcardDeck) (utils.DeckCoverage, error) {
+	coverage := utils.DeckCoverage{
+		Deck:  deck.Id,
+		Title: deck.Title,
+		Cards: len(deck.Cards),
+	}
+
+	pc, err := utils.GetPineconeClient()
+	if err != nil {
+		return coverage, fmt.Errorf("error connecting to pinecone client: %v", err)
+	}
+
+	cardIds := []string{}
+	for _, card := range deck.Cards {
+		cardIds = append(cardIds, card.Uuid)
+	}
+
+	embeddings, err := pc.FetchPatternEmbeddings(cardIds)
+	if err != nil {
+		return coverage, err
+	}
+
+	coverage.Unindexed = len(deck.Cards) - len(embeddings)
+	if len(embeddings) < utils.MIN_COVERAGE_CARDS {
+		return coverage, errTooFewIndexed
+	}
+
+	registry, err := prompts.Get()
+	if err != nil {
+		return coverage, fmt.Errorf("error loading prompt templates: %v", err)
+	}
+
+	outline := utils.ResizeOutline(deck.Outline, len(embeddings))
+	if len(outline) == 0 {
+		outline, _, err = deckOutline(registry, "", utils.DeckRequest{Prompt: deck.Title, Size: len(embeddings)})
+		if err != nil {
+			return coverage, fmt.Errorf("error generating deck outline: %v", err)
+		}
+
+		ds, err := utils.GetDeckStore()
+		if err != nil {
+			return coverage, err
+		}
+		if err := ds.SetOutline(deck.Id, deck.Owner, outline); err != nil {
+			return coverage, fmt.Errorf("error saving deck outline: %v", err)
+		}
+	}
+
+	coverage.Clusters = utils.ClusterCards(deck.Cards, embeddings)
+
+	labelPrompt, _, err := registry.Render(prompts.CoverageLabels, "", map[string]any{
+		"Title":    deck.Title,
+		"Clusters": coverage.Clusters,
+	})
+	if err != nil {
+		return coverage, err
+	}
+
+	messages := []utils.Message{
+		{
+			Role:    "user",
+			Content: labelPrompt,
+		},
+	}
+	if err := utils.LabelClusters(messages, coverage.Clusters); err != nil {
+		return coverage, fmt.Errorf("error labelling clusters: %v", err)
+	}
+
+	coverage.Subtopics, coverage.OffOutline, err = utils.CompareCoverage(outline, coverage.Clusters, embeddings)
+	if err != nil {
+		return coverage, err
+	}
+
+	return coverage, nil
+}
+
+// DeckCoverageHandler serves GET /decks/{id}/coverage. It clusters the
+// deck's cards by their stored embeddings, labels each cluster and reports
+// which subtopics of the deck's outline are over- or under-represented.
+// When some are short of cards, "fillGaps" describes the request that
+// generates them.
+func DeckCoverageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	deck, ok := ownedDeck(w, r)
+	if !ok {
+		return
+	}
+
+	coverage, err := deckCoverage(deck)
+	if errors.Is(err, errTooFewIndexed) {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("%v, %d of its %d cards are indexed", err, coverage.Cards-coverage.Unindexed, coverage.Cards))
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error analysing deck coverage: %v", err))
+		return
+	}
+
+	response := map[string]any{"coverage": coverage}
+	if gaps := coverage.Gaps(); len(gaps) > 0 {
+		response["fillGaps"] = map[string]any{
+			"method": http.MethodPost,
+			"path":   fmt.Sprintf("/decks/%s/coverage/fill", deck.Id),
+			"body":   FillGapsRequest{Subtopics: gaps},
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// FillGapsHandler serves POST /decks/{id}/coverage/fill, generating each
+// gap subtopic's missing cards into the deck. It streams "gaps", "card",
+// "status" and "complete" events like /generate-deck.
+func FillGapsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req FillGapsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if !req.CardType.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Card type must be basic, cloze or multiple_choice")
+		return
+	}
+
+	deck, ok := ownedDeck(w, r)
+	if !ok {
+		return
+	}
+
+	registry, err := prompts.Get()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error loading prompt templates")
+		return
+	}
+
+	templateName := generationTemplate(req.CardType)
+	if req.PromptVersion != "" && !registry.Has(templateName, req.PromptVersion) {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown prompt version %s, see /prompts", req.PromptVersion))
+		return
+	}
+
+	prompt, version, err := registry.Render(templateName, req.PromptVersion, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	subtopics := req.Subtopics
+	if len(subtopics) == 0 {
+		coverage, err := deckCoverage(deck)
+		if errors.Is(err, errTooFewIndexed) {
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error analysing deck coverage: %v", err))
+			return
+		}
+		subtopics = coverage.Subtopics
+	}
+
+	// Every subtopic is listed to the model so gap cards stay out of the
+	// covered ones, but only the gaps get cards, up to MAX_DECK_SIZE in all
+	outline := []utils.Subtopic{}
+	gaps := []utils.Subtopic{}
+	size := 0
+	for _, subtopic := range subtopics {
+		if subtopic.Title == "" {
+			continue
+		}
+		outline = append(outline, subtopic.Subtopic)
+
+		missing := min(subtopic.Missing, utils.MAX_DECK_SIZE-size)
+		if missing <= 0 {
+			continue
+		}
+
+		gap := subtopic.Subtopic
+		gap.Cards = missing
+		gaps = append(gaps, gap)
+		size += missing
+	}
+
+	if len(gaps) == 0 {
+		respondWithJSON(w, http.StatusOK, map[string]any{
+			"message": "Deck has no gaps to fill",
+			"cards":   []utils.Flashcard{},
+		})
+		return
+	}
+
+	stream, err := sse.NewWriter(w)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	generation := &deckGeneration{
+		stream:       stream,
+		registry:     registry,
+		systemPrompt: prompt,
+		version:      version,
+		cardType:     req.CardType,
+		size:         size,
+		templates:    []string{prompts.Id(templateName, version)},
+		deck: utils.FlashcardDeck{
+			Id:    deck.Id,
+			Cards: []utils.Flashcard{},
+			Title: deck.Title,
+			Owner: deck.Owner,
+		},
+	}
+
+	stopHeartbeat := stream.StartHeartbeat(sse.DEFAULT_HEARTBEAT_INTERVAL, func() any {
+		generated, cards := generation.progress()
+
+		return map[string]interface{}{
+			"generated": generated,
+			"cards":     cards,
+			"time":      time.Now().Unix(),
+		}
+	})
+	defer stopHeartbeat()
+
+	stream.Send("gaps", map[string]interface{}{
+		"size":      size,
+		"subtopics": gaps,
+	})
+
+	ctx := r.Context()
+	for i, gap := range gaps {
+		if ctx.Err() != nil {
+			log.Println("Client disconnected, stopping gap filling")
+			return
+		}
+
+		stream.Send("status", map[string]interface{}{
+			"message":  fmt.Sprintf("Filling gap %d of %d: %s", i+1, len(gaps), gap.Title),
+			"subtopic": gap.Title,
+		})
+
+		if err := generation.generateSubtopic(ctx, gap, outline); err != nil {
+			stream.Error("Error processing generation request", err)
+			return
+		}
+	}
+
+	complete := map[string]interface{}{
+		"message":  "Gaps filled",
+		"progress": 100,
+		"cards":    generation.deck.Cards,
+	}
+	if len(generation.shortfalls) > 0 {
+		complete["message"] = fmt.Sprintf("Gaps filled with %d of %d cards", generation.generated, size)
+		complete["shortfalls"] = generation.shortfalls
+	}
+	stream.Send("complete", complete)
+}
@@ -1,35 +1,26 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 
+	"sanctum/middleware"
+	"sanctum/prompts"
+	"sanctum/sse"
 	"sanctum/utils"
 )
 
-const systemPrompt = `You are a helpful study aid that creates flashcard pairs in JSON format. For any topic provided, generate relevant question-answer pairs where "pattern" contains the prompt/question and "match" contains the corresponding answer. Format each flashcard as a JSON object with these exact fields:
-{ "pattern": string, "match": string }
-
-Return multiple flashcards as a plain array of these objects - do not wrap in any additional object. Ensure the content is accurate and educational. Only respond with the JSON array, no additional text.
-
-Example format:
-[
-  {
-    "pattern": "What is photosynthesis?",
-    "match": "Process where plants convert sunlight, water and CO2 into glucose and oxygen"
-  },
-  {
-    "pattern": "In what year did World War II end?",
-    "match": "1945"
-  }
-]`
-
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -46,215 +37,494 @@ func respondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
 	json.NewEncoder(w).Encode(payload)
 }
 
-// TODO: Retry logic, error handling, etc.
-func GenerateDeckHandler(w http.ResponseWriter, r *http.Request) {
-	// Set headers for SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		respondWithError(w, http.StatusInternalServerError, "Streaming unsupported")
-		return
+// generationTemplate names the system prompt template for cardType
+func generationTemplate(cardType utils.CardType) string {
+	switch cardType {
+	case utils.CardCloze:
+		return prompts.DeckCloze
+	case utils.CardMultipleChoice:
+		return prompts.DeckChoice
+	}
+	return prompts.DeckBasic
+}
+
+// expandCard turns a generated card into the cards that get stored: a cloze
+// note becomes one card per deletion, and a multiple-choice card has its
+// distractors filtered
+func expandCard(card utils.Flashcard) ([]utils.Flashcard, error) {
+	if err := card.Validate(); err != nil {
+		return nil, err
 	}
 
-	// Helper function to send SSE updates
-	sendUpdate := func(eventType string, data interface{}) {
-		update, err := json.Marshal(data)
+	switch card.Type {
+	case utils.CardCloze:
+		return utils.ExpandCloze(card)
+	case utils.CardMultipleChoice:
+		prepared, err := utils.PrepareMultipleChoice(card)
 		if err != nil {
-			log.Printf("Error marshaling update: %v", err)
-			return
+			return nil, err
 		}
-		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, update)
-		flusher.Flush()
+		return []utils.Flashcard{prepared}, nil
 	}
+	return []utils.Flashcard{card}, nil
+}
 
-	if r.Method != http.MethodPost {
-		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
-	}
+// deckGeneration writes a deck's cards one outline subtopic at a time,
+// queueing each card for indexing and streaming it to the client as soon as
+// it's complete
+type deckGeneration struct {
+	stream       *sse.Writer
+	registry     *prompts.Registry
+	systemPrompt string
+	version      string
+	cardType     utils.CardType
+	deck         utils.FlashcardDeck
+	size         int
+
+	// The ids of the templates used for every subtopic, to which each card
+	// adds its subtopic prompt's
+	templates []string
+
+	// Guards deck.Cards and generated against the heartbeat's reads
+	mu         sync.Mutex
+	generated  int
+	shortfalls []subtopicShortfall
+}
 
-	var req utils.DeckRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
-		return
+func (g *deckGeneration) progress() (int, int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.generated, len(g.deck.Cards)
+}
+
+// keep queues a generated card for indexing and streams it to the client,
+// returning false if it couldn't be expanded and was skipped. userTemplate is
+// the id of the template for the request that produced it.
+func (g *deckGeneration) keep(card utils.Flashcard, userTemplate string) (bool, error) {
+	card.Uuid = uuid.New().String()
+	card.Deck = g.deck.Id
+	card.Owner = g.deck.Owner
+	card.Templates = append(slices.Clone(g.templates), userTemplate)
+	card = card.Stamp(utils.SOURCE_GENERATED)
+
+	expanded, err := expandCard(card)
+	if err != nil {
+		log.Println("Skipping generated card:", err)
+		return false, nil
 	}
 
-	if req.Prompt == "" {
-		respondWithError(w, http.StatusBadRequest, "Prompt cannot be empty")
-		return
+	if err := queueCards(g.deck.Title, expanded); err != nil {
+		return false, fmt.Errorf("error saving cards: %v", err)
 	}
 
-	// TODO: This needs to be configurable somehow
-	targetSize := 20
-	var allCards []utils.Flashcard
+	for _, card := range expanded {
+		g.stream.Send("card", card)
+	}
 
-	sendUpdate("status", map[string]interface{}{
-		"message":  "Starting generation...",
-		"progress": 1,
-	})
+	g.mu.Lock()
+	g.deck.Cards = append(g.deck.Cards, expanded...)
+	g.generated += 1
+	generated := g.generated
+	g.mu.Unlock()
 
-	// Initial request to generate first set of cards
-	initialMessages := []utils.Message{
-		{
-			Role:    "system",
-			Content: systemPrompt,
-		},
-		{
-			Role:    "user",
-			Content: fmt.Sprintf("Generate 2-3 flashcards about %s.", req.Prompt),
-		},
+	status := map[string]interface{}{
+		"message":  fmt.Sprintf("%d of %d cards generated", generated, g.size),
+		"progress": float64(generated) / float64(g.size) * 100,
+	}
+	if card.Subtopic != "" {
+		status["subtopic"] = card.Subtopic
 	}
+	g.stream.Send("status", status)
 
-	var initialCards []utils.Flashcard
+	return true, nil
+}
 
-	response, err := utils.MakeOpenAIChatRequest(initialMessages, utils.GetFlashcardSchema())
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error processing initial request")
-		return
+// A subtopic whose requests keep coming back short is asked for the rest
+// this many times in all before it's reported as a shortfall
+const MAX_SUBTOPIC_ATTEMPTS = 3
+
+// subtopicShortfall is a subtopic that got fewer cards than its share
+type subtopicShortfall struct {
+	Subtopic  string `json:"subtopic"`
+	Cards     int    `json:"cards"`
+	Generated int    `json:"generated"`
+}
+
+// generateSubtopic asks for subtopic.Cards cards on subtopic, re-requesting
+// whatever the model leaves out up to MAX_SUBTOPIC_ATTEMPTS times and
+// recording a shortfall if it's still short
+func (g *deckGeneration) generateSubtopic(ctx context.Context, subtopic utils.Subtopic, outline []utils.Subtopic) error {
+	written := 0
+	for attempt := 0; attempt < MAX_SUBTOPIC_ATTEMPTS && written < subtopic.Cards; attempt += 1 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		n, err := g.requestSubtopic(ctx, subtopic, subtopic.Cards-written, outline)
+		written += n
+		if err != nil {
+			return err
+		}
 	}
 
-	var rawResponse any
-	if err := json.Unmarshal([]byte(response), &rawResponse); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error parsing initial flashcards")
-		return
+	if written < subtopic.Cards {
+		g.mu.Lock()
+		g.shortfalls = append(g.shortfalls, subtopicShortfall{Subtopic: subtopic.Title, Cards: subtopic.Cards, Generated: written})
+		g.mu.Unlock()
 	}
 
-	if responseMap, ok := rawResponse.(map[string]any); ok {
-		if cardsRaw, ok := responseMap["cards"].([]any); ok {
-			cardsJSON, err := json.Marshal(cardsRaw)
-			if err != nil {
-				respondWithError(w, http.StatusInternalServerError, "Error re-encoding cards")
-				return
-			}
+	return nil
+}
 
-			if err := json.Unmarshal(cardsJSON, &initialCards); err != nil {
-				respondWithError(w, http.StatusInternalServerError, "Error parsing cards array")
-				return
-			}
+// requestSubtopic asks for count cards on subtopic, telling the model which
+// of the outline's other subtopics to stay out of, and returns how many it
+// kept. Only the prompt for this subtopic is sent, so it stays the same size
+// however big the deck gets.
+func (g *deckGeneration) requestSubtopic(ctx context.Context, subtopic utils.Subtopic, count int, outline []utils.Subtopic) (int, error) {
+	others := []string{}
+	for _, other := range outline {
+		if other.Title != subtopic.Title {
+			others = append(others, other.Title)
 		}
 	}
 
-	// TODO: I think at some point we'll want to do something like parallelize this to speed things along
-	//       I don't think the embeddings have any dependencies except the cards to which they're directly linked
-	for i := range initialCards {
-		initialCards[i].Uuid = uuid.New().String()
+	userPrompt, subtopicVersion, err := g.registry.RenderPreferred(prompts.DeckSubtopic, g.version, map[string]any{
+		"Topic":       g.deck.Title,
+		"Subtopic":    subtopic.Title,
+		"Description": subtopic.Description,
+		"Count":       count,
+		"Others":      strings.Join(others, "; "),
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	err = addCardsToPinecone(initialCards)
-	if err != nil {
-		log.Println("Error adding initial cards to Pinecone:", err)
-		respondWithError(w, http.StatusInternalServerError, "Error adding card to Pinecone")
-		return
+	messages := []utils.Message{
+		{
+			Role:    "system",
+			Content: g.systemPrompt,
+		},
+		{
+			Role:    "user",
+			Content: userPrompt,
+		},
 	}
 
-	allCards = append(allCards, initialCards...)
+	// Cancelled once the subtopic has its cards, in case the model writes more
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	sendUpdate("status", map[string]interface{}{
-		"message":  "Initial cards generated",
-		"progress": float64(len(allCards)) / float64(targetSize) * 100,
-	})
+	cards, errc := utils.MakeOpenAIFlashcardStreamRequest(ctx, messages, g.cardType)
+
+	written := 0
+	for card := range cards {
+		if written == count {
+			cancel()
+			continue
+		}
 
-	for len(allCards) < targetSize {
-		currentDeckJSON, err := json.Marshal(allCards)
+		card.Subtopic = subtopic.Title
+		kept, err := g.keep(card, prompts.Id(prompts.DeckSubtopic, subtopicVersion))
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Error encoding current deck")
-			return
+			return written, err
 		}
+		if kept {
+			written += 1
+		}
+	}
 
-		expansionPrompt := fmt.Sprintf(`Here is my current deck of flashcards:
+	// Once the subtopic has its cards, an error is just the early cancel above
+	// or the extra cards failing, which doesn't matter
+	if err := <-errc; err != nil && written < count {
+		return written, err
+	}
 
-%s
+	return written, nil
+}
 
-Please generate 2-3 additional flashcards that expand the knowledge covered by this deck. Focus on related but new concepts.`, string(currentDeckJSON))
+// generateExpanding is how v1 prompt sets generate a deck, kept for clients
+// that pin one: a few cards on the topic, then rounds of a few more that
+// expand on the deck so far until it has g.size cards. It gives up, recording
+// a shortfall, after MAX_SUBTOPIC_ATTEMPTS rounds in a row add nothing.
+func (g *deckGeneration) generateExpanding(ctx context.Context) error {
+	userPrompt, userVersion, err := g.registry.RenderPreferred(prompts.DeckTopic, g.version, map[string]any{"Topic": g.deck.Title})
+	if err != nil {
+		return err
+	}
+	userTemplate := prompts.Id(prompts.DeckTopic, userVersion)
 
+	for emptyRounds := 0; emptyRounds < MAX_SUBTOPIC_ATTEMPTS; {
 		messages := []utils.Message{
 			{
 				Role:    "system",
-				Content: systemPrompt,
+				Content: g.systemPrompt,
 			},
 			{
 				Role:    "user",
-				Content: expansionPrompt,
+				Content: userPrompt,
 			},
 		}
 
-		response, err := utils.MakeOpenAIChatRequest(messages, utils.GetFlashcardSchema())
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Error processing expansion request")
-			return
+		kept := 0
+		cards, errc := utils.MakeOpenAIFlashcardStreamRequest(ctx, messages, g.cardType)
+		for card := range cards {
+			ok, err := g.keep(card, userTemplate)
+			if err != nil {
+				return err
+			}
+			if ok {
+				kept += 1
+			}
 		}
-
-		var rawResponse any
-		if err := json.Unmarshal([]byte(response), &rawResponse); err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Error parsing initial flashcards")
-			return
+		if err := <-errc; err != nil {
+			return err
 		}
 
-		if responseMap, ok := rawResponse.(map[string]any); ok {
-			if cardsRaw, ok := responseMap["cards"].([]any); ok {
-				cardsJSON, err := json.Marshal(cardsRaw)
-				if err != nil {
-					respondWithError(w, http.StatusInternalServerError, "Error re-encoding cards")
-					return
-				}
-
-				if err := json.Unmarshal(cardsJSON, &initialCards); err != nil {
-					respondWithError(w, http.StatusInternalServerError, "Error parsing cards array")
-					return
-				}
-			}
+		if generated, _ := g.progress(); generated >= g.size {
+			return nil
+		}
+		if kept == 0 {
+			emptyRounds += 1
+		} else {
+			emptyRounds = 0
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 
-		// TODO: The error handling here needs to be more robust
-		//       probably something like having a local backlog of un-indexed cards
-		for i := range initialCards {
-			initialCards[i].Uuid = uuid.New().String()
+		g.mu.Lock()
+		deckJSON, err := json.Marshal(g.deck.Cards)
+		g.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("error encoding current deck: %v", err)
 		}
 
-		err = addCardsToPinecone(initialCards)
+		userPrompt, userVersion, err = g.registry.RenderPreferred(prompts.DeckExpand, g.version, map[string]any{"Deck": string(deckJSON)})
 		if err != nil {
-			log.Println("Error adding new cards to Pinecone:", err)
-			respondWithError(w, http.StatusInternalServerError, "Error adding cards to Pinecone")
+			return err
+		}
+		userTemplate = prompts.Id(prompts.DeckExpand, userVersion)
+	}
+
+	g.mu.Lock()
+	g.shortfalls = append(g.shortfalls, subtopicShortfall{Subtopic: g.deck.Title, Cards: g.size, Generated: g.generated})
+	g.mu.Unlock()
+
+	return nil
+}
+
+// GenerateDeckHandler generates a deck curriculum-first: it streams an
+// "outline" event of the topic's subtopics, each with its share of the deck's
+// size, then generates each subtopic's cards in turn. A request pinned to a
+// prompt version from before outlines, like v1, is generated the old way
+// and gets no outline.
+func GenerateDeckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req utils.DeckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Prompt == "" {
+		respondWithError(w, http.StatusBadRequest, "Prompt cannot be empty")
+		return
+	}
+
+	if !req.CardType.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Card type must be basic, cloze or multiple_choice")
+		return
+	}
+
+	if req.Size == 0 {
+		req.Size = utils.DEFAULT_DECK_SIZE
+	}
+	if req.Size < 1 || req.Size > utils.MAX_DECK_SIZE {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Size must be between 1 and %d", utils.MAX_DECK_SIZE))
+		return
+	}
+
+	registry, err := prompts.Get()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error loading prompt templates")
+		return
+	}
+
+	templateName := generationTemplate(req.CardType)
+	promptVersion := req.PromptVersion
+	if promptVersion != "" && !registry.Has(templateName, promptVersion) {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown prompt version %s, see /prompts", promptVersion))
+		return
+	}
+
+	prompt, version, err := registry.Render(templateName, promptVersion, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	stream, err := sse.NewWriter(w)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	generation := &deckGeneration{
+		stream:       stream,
+		registry:     registry,
+		systemPrompt: prompt,
+		version:      version,
+		cardType:     req.CardType,
+		size:         req.Size,
+		templates:    []string{prompts.Id(templateName, version)},
+		deck: utils.FlashcardDeck{
+			Id:    uuid.New().String(),
+			Cards: []utils.Flashcard{},
+			Title: req.Prompt,
+			Owner: middleware.UserId(r),
+		},
+	}
+
+	stream.Send("status", map[string]interface{}{
+		"message":  "Starting generation...",
+		"progress": 1,
+	})
+
+	stopHeartbeat := stream.StartHeartbeat(sse.DEFAULT_HEARTBEAT_INTERVAL, func() any {
+		generated, cards := generation.progress()
+
+		return map[string]interface{}{
+			"generated": generated,
+			"cards":     cards,
+			"time":      time.Now().Unix(),
+		}
+	})
+	defer stopHeartbeat()
+
+	ctx := r.Context()
+
+	// Prompt sets from before outlines keep generating the way they did
+	if registry.Has(prompts.DeckTopic, version) {
+		if err := generation.generateExpanding(ctx); err != nil {
+			stream.Error("Error processing generation request", err)
 			return
 		}
 
-		allCards = append(allCards, initialCards...)
+		complete := map[string]interface{}{
+			"message":  "Deck generation complete",
+			"progress": 100,
+			"deck":     generation.deck,
+		}
+		if len(generation.shortfalls) > 0 {
+			complete["message"] = fmt.Sprintf("Deck generation complete with %d of %d cards", generation.generated, req.Size)
+			complete["shortfalls"] = generation.shortfalls
+		}
+		stream.Send("complete", complete)
+		return
+	}
+
+	outline, outlineTemplate, err := deckOutline(registry, version, req)
+	if err != nil {
+		stream.Error("Error generating deck outline", err)
+		return
+	}
+	if outlineTemplate != "" {
+		generation.templates = append(generation.templates, outlineTemplate)
+	}
 
-		// TODO: I think eventually we'll want this to be some sort of keep-alive
-		fmt.Printf("%d of %d cards...", len(allCards), targetSize)
+	stream.Send("outline", map[string]interface{}{
+		"size":      req.Size,
+		"subtopics": outline,
+	})
 
-		sendUpdate("status", map[string]interface{}{
-			"message":  "Initial cards generated",
-			"progress": float64(len(allCards)) / float64(targetSize) * 100,
+	for i, subtopic := range outline {
+		if ctx.Err() != nil {
+			log.Println("Client disconnected, stopping deck generation")
+			return
+		}
+
+		stream.Send("status", map[string]interface{}{
+			"message":  fmt.Sprintf("Generating subtopic %d of %d: %s", i+1, len(outline), subtopic.Title),
+			"subtopic": subtopic.Title,
 		})
 
-		time.Sleep(time.Second / 5)
+		if err := generation.generateSubtopic(ctx, subtopic, outline); err != nil {
+			stream.Error("Error processing generation request", err)
+			return
+		}
 	}
 
-	deck := utils.FlashcardDeck{
-		Cards: allCards,
-		Title: req.Prompt,
+	// Kept so coverage reports compare the deck with the outline it was
+	// generated from. A deck that got no cards was never saved.
+	if ds, err := utils.GetDeckStore(); err == nil {
+		if err := ds.SetOutline(generation.deck.Id, generation.deck.Owner, outline); err != nil && !errors.Is(err, utils.ErrDeckNotFound) {
+			log.Println("Error saving deck outline:", err)
+		}
 	}
 
 	log.Println("Returning deck")
 
-	sendUpdate("complete", map[string]interface{}{
+	complete := map[string]interface{}{
 		"message":  "Deck generation complete",
 		"progress": 100,
-		"deck": utils.FlashcardDeck{
-			Cards: allCards,
-			Title: req.Prompt,
-		},
+		"deck":     generation.deck,
+		"outline":  outline,
+	}
+	if len(generation.shortfalls) > 0 {
+		complete["message"] = fmt.Sprintf("Deck generation complete with %d of %d cards", generation.generated, req.Size)
+		complete["shortfalls"] = generation.shortfalls
+	}
+	stream.Send("complete", complete)
+}
+
+// deckOutline is the outline a deck request gives, or one generated for its
+// prompt when it doesn't give one, along with the id of the template that
+// generated it
+func deckOutline(registry *prompts.Registry, version string, req utils.DeckRequest) ([]utils.Subtopic, string, error) {
+	if len(req.Subtopics) > 0 {
+		subtopics := []utils.Subtopic{}
+		for _, title := range req.Subtopics {
+			subtopics = append(subtopics, utils.Subtopic{Title: title})
+		}
+
+		outline := utils.NewOutline(subtopics, req.Size)
+		if len(outline) == 0 {
+			return nil, "", fmt.Errorf("subtopics are all empty")
+		}
+		return outline, "", nil
+	}
+
+	systemPrompt, outlineVersion, err := registry.RenderPreferred(prompts.DeckOutline, version, map[string]any{
+		"Size": req.Size,
+		"Min":  min(3, req.Size),
+		"Max":  min(utils.MAX_OUTLINE_SUBTOPICS, req.Size),
 	})
+	if err != nil {
+		return nil, "", err
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(deck); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error encoding final response")
-		return
+	messages := []utils.Message{
+		{
+			Role:    "system",
+			Content: systemPrompt,
+		},
+		{
+			Role:    "user",
+			Content: req.Prompt,
+		},
+	}
+
+	outline, err := utils.GenerateOutline(messages, req.Size)
+	if err != nil {
+		return nil, "", err
 	}
+
+	return outline, prompts.Id(prompts.DeckOutline, outlineVersion), nil
 }
 
 func GradeHandler(w http.ResponseWriter, r *http.Request) {
@@ -291,32 +561,55 @@ func GradeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	numericGrade, err := utils.Grade(pc, gradeRequest.Uuid, gradeRequest.Answer)
+	policy, err := utils.DefaultGradingPolicy().WithOverrides(gradeRequest)
 	if err != nil {
-		errMessage := fmt.Sprintf("Error grading answer: %v", err)
-		respondWithError(w, http.StatusInternalServerError, errMessage)
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	respondWithJSON(w, 200, map[string]any{
-		"numericGrade": numericGrade,
-	})
+	result, err := utils.Grade(pc, middleware.UserId(r), gradeRequest, policy)
+	if errors.Is(err, utils.ErrCardIndexing) {
+		respondWithJSON(w, http.StatusAccepted, map[string]any{
+			"status":  "indexing",
+			"message": "Card is still being indexed, try again shortly",
+		})
+		return
+	}
+	if err != nil {
+		status, message := gradeError(err)
+		respondWithError(w, status, message)
+		return
+	}
+
+	respondWithJSON(w, 200, result)
 }
 
-func addCardsToPinecone(cards []utils.Flashcard) error {
-	for _, card := range cards {
-		if card.Uuid == "" {
-			return fmt.Errorf("Flashcard UUID is not set")
-		}
+// queueCards writes the cards to the outbox, which embeds and upserts them
+// in the background, and saves them to their decks, creating any new deck
+// with the given title. Once this returns the cards are safe on disk.
+func queueCards(title string, cards []utils.Flashcard) error {
+	ob, err := utils.GetOutbox()
+	if err != nil {
+		return err
 	}
 
-	pc, err := utils.GetPineconeClient()
+	ds, err := utils.GetDeckStore()
 	if err != nil {
 		return err
 	}
 
-	_, err = pc.AddCards(cards)
-	if err != nil {
+	// Saved to the deck first, since once the cards are queued they'll be
+	// indexed whether or not they made it into the deck
+	if err := ds.Add(title, cards); err != nil {
+		return err
+	}
+
+	if err := ob.Enqueue(cards); err != nil {
+		for _, card := range cards {
+			if err := ds.Remove(card.Uuid); err != nil {
+				log.Println("Error removing unqueued card from its deck:", err)
+			}
+		}
 		return err
 	}
 
@@ -339,16 +632,102 @@ func AddCardHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !card.Type.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Card type must be basic, cloze or multiple_choice")
+		return
+	}
+
+	if !card.Difficulty.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Difficulty must be easy, medium or hard")
+		return
+	}
+
+	if err := card.Validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid card: %v", err))
+		return
+	}
+
 	card.Uuid = uuid.New().String()
+	card.Owner = middleware.UserId(r)
+	card = card.Stamp(utils.SOURCE_MANUAL)
+
+	if card.Deck != "" {
+		ds, err := utils.GetDeckStore()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error opening deck store")
+			return
+		}
 
-	err = addCardsToPinecone([]utils.Flashcard{card})
+		// Other users' decks look the same as missing ones
+		if !ds.CanAdd(card.Deck, card.Owner) {
+			respondWithError(w, http.StatusNotFound, "Deck not found")
+			return
+		}
+	}
+
+	// A cloze note becomes one card per deletion index
+	cards := []utils.Flashcard{card}
+	switch card.Type {
+	case utils.CardCloze:
+		cards, err = utils.ExpandCloze(card)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid cloze card: %v", err))
+			return
+		}
+	case utils.CardMultipleChoice:
+		card, err = utils.PrepareMultipleChoice(card)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid multiple-choice card: %v", err))
+			return
+		}
+		cards = []utils.Flashcard{card}
+	}
+
+	err = queueCards("", cards)
+	if errors.Is(err, utils.ErrDeckNotOwned) {
+		respondWithError(w, http.StatusNotFound, "Deck not found")
+		return
+	}
 	if err != nil {
-		log.Println("Error adding card to Pinecone:", err)
-		respondWithError(w, http.StatusInternalServerError, "Error adding card to Pinecone")
+		log.Println("Error queueing card:", err)
+		respondWithError(w, http.StatusInternalServerError, "Error saving card")
 		return
 	}
 
-	respondWithJSON(w, 200, map[string]string{"message": "Card added successfully"})
+	if card.Type == utils.CardCloze {
+		respondWithJSON(w, 200, map[string]any{"message": "Card added successfully", "parent": card.Uuid, "cards": cards, "status": utils.OutboxPending})
+		return
+	}
+
+	if card.Type == utils.CardMultipleChoice {
+		respondWithJSON(w, 200, map[string]any{"message": "Card added successfully", "uuid": card.Uuid, "options": card.Options, "status": utils.OutboxPending})
+		return
+	}
+
+	respondWithJSON(w, 200, map[string]string{"message": "Card added successfully", "uuid": card.Uuid, "status": string(utils.OutboxPending)})
+}
+
+// cardOwnedBy returns utils.ErrCardNotFound unless owner owns the card,
+// checking the outbox first for cards that aren't indexed yet
+func cardOwnedBy(pc *utils.PineconeClient, ob *utils.Outbox, cardId string, owner string) error {
+	if entry, ok := ob.Entry(cardId); ok {
+		if entry.Card.Owner != owner {
+			return utils.ErrCardNotFound
+		}
+		return nil
+	}
+
+	stored, err := pc.FetchCard(cardId)
+	if err != nil {
+		return err
+	}
+
+	// Other users' cards look the same as missing ones
+	if stored.Card.Owner != owner {
+		return utils.ErrCardNotFound
+	}
+
+	return nil
 }
 
 func RemoveCardHandler(w http.ResponseWriter, r *http.Request) {
@@ -373,6 +752,42 @@ func RemoveCardHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ob, err := utils.GetOutbox()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error opening card outbox")
+		return
+	}
+
+	err = cardOwnedBy(pc, ob, card.Uuid, middleware.UserId(r))
+	if errors.Is(err, utils.ErrCardNotFound) {
+		respondWithError(w, http.StatusNotFound, "Card not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error removing card: %v", err))
+		return
+	}
+
+	err = ob.Remove(card.Uuid)
+	if err != nil {
+		errMessage := fmt.Sprintf("Error removing card: %v", err)
+		respondWithError(w, http.StatusInternalServerError, errMessage)
+		return
+	}
+
+	ds, err := utils.GetDeckStore()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error opening deck store")
+		return
+	}
+
+	err = ds.Remove(card.Uuid)
+	if err != nil {
+		errMessage := fmt.Sprintf("Error removing card: %v", err)
+		respondWithError(w, http.StatusInternalServerError, errMessage)
+		return
+	}
+
 	_, err = pc.RemoveCard(card.Uuid)
 	if err != nil {
 		errMessage := fmt.Sprintf("Error removing card: %v", err)
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"sanctum/middleware"
+	"sanctum/utils"
+)
+
+var unsafeFilenamePattern = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// exportFilename turns a deck title into something safe to put in a
+// Content-Disposition header
+func exportFilename(deck utils.FlashcardDeck, format utils.ExportFormat) string {
+	name := strings.Trim(unsafeFilenamePattern.ReplaceAllString(deck.Title, "-"), "-.")
+	if name == "" {
+		name = deck.Id
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name + "." + string(format)
+}
+
+// ownedDeck looks up the deck in the request path, responding with an error
+// and returning false if the user doesn't have it
+func ownedDeck(w http.ResponseWriter, r *http.Request) (utils.FlashcardDeck, bool) {
+	owner := middleware.UserId(r)
+	if owner == "" {
+		respondWithError(w, http.StatusUnauthorized, "Token has no user, request a new one from /auth")
+		return utils.FlashcardDeck{}, false
+	}
+
+	ds, err := utils.GetDeckStore()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error opening deck store")
+		return utils.FlashcardDeck{}, false
+	}
+
+	deck, err := ds.Get(r.PathValue("id"), owner)
+	if errors.Is(err, utils.ErrDeckNotFound) {
+		// Decks made before the deck store existed aren't in it either
+		respondWithError(w, http.StatusNotFound, "Deck not found. Decks made before deck export was added can't be exported or analysed, but their cards can still be searched")
+		return utils.FlashcardDeck{}, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error reading deck: %v", err))
+		return utils.FlashcardDeck{}, false
+	}
+
+	return deck, true
+}
+
+// ExportDeckHandler serves GET /decks/{id}/export?format=apkg|csv|tsv|json|md,
+// defaulting to JSON, as a file download
+func ExportDeckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	format := utils.ExportFormat(r.URL.Query().Get("format"))
+	if format == "" {
+		format = utils.ExportJSON
+	}
+	if !format.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Format must be one of apkg, csv, tsv, json or md")
+		return
+	}
+
+	deck, ok := ownedDeck(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := utils.ExportDeck(deck, format)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error exporting deck: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(deck, format)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		log.Println("Error writing export:", err)
+	}
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"sanctum/middleware"
+	"sanctum/prompts"
+	"sanctum/sse"
+	"sanctum/utils"
+)
+
+const DEFAULT_CARDS_PER_CHUNK = 3
+const MAX_CARDS_PER_CHUNK = 10
+
+// GenerateFromDocumentHandler serves POST /generate-deck/from-document. It
+// takes a multipart upload with the document in "file" and optional "title",
+// "cardType", "cardsPerChunk" and "promptVersion" fields, and streams cards the same way as
+// GenerateDeckHandler, generating each chunk's cards from that chunk alone.
+func GenerateFromDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Leave room for the multipart framing and the other fields
+	r.Body = http.MaxBytesReader(w, r.Body, utils.MAX_DOCUMENT_SIZE+64<<10)
+	if err := r.ParseMultipartForm(utils.MAX_DOCUMENT_SIZE); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid upload, documents can be at most %d bytes", utils.MAX_DOCUMENT_SIZE))
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "A document must be uploaded in the file field")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error reading document")
+		return
+	}
+
+	cardType := utils.CardType(r.FormValue("cardType"))
+	if !cardType.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Card type must be basic, cloze or multiple_choice")
+		return
+	}
+
+	cardsPerChunk := DEFAULT_CARDS_PER_CHUNK
+	if raw := r.FormValue("cardsPerChunk"); raw != "" {
+		cardsPerChunk, err = strconv.Atoi(raw)
+		if err != nil || cardsPerChunk < 1 || cardsPerChunk > MAX_CARDS_PER_CHUNK {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("cardsPerChunk must be between 1 and %d", MAX_CARDS_PER_CHUNK))
+			return
+		}
+	}
+
+	format := utils.DetectDocumentFormat(header.Filename, header.Header.Get("Content-Type"))
+	text, err := utils.ExtractDocumentText(data, format)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid document: %v", err))
+		return
+	}
+
+	chunks := utils.ChunkDocument(text)
+	if len(chunks) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Document has no text")
+		return
+	}
+	if len(chunks) > utils.MAX_DOCUMENT_CHUNKS {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Document is too long: %d chunks, at most %d", len(chunks), utils.MAX_DOCUMENT_CHUNKS))
+		return
+	}
+
+	registry, err := prompts.Get()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error loading prompt templates")
+		return
+	}
+
+	templateName := generationTemplate(cardType)
+	promptVersion := r.FormValue("promptVersion")
+	if promptVersion != "" && !registry.Has(templateName, promptVersion) {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown prompt version %s, see /prompts", promptVersion))
+		return
+	}
+
+	prompt, version, err := registry.Render(templateName, promptVersion, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	grounding, groundingVersion, err := registry.RenderPreferred(prompts.DocumentGrounding, version, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	templates := []string{prompts.Id(templateName, version), prompts.Id(prompts.DocumentGrounding, groundingVersion)}
+	prompt += "\n\n" + grounding
+
+	document := filepath.Base(header.Filename)
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" {
+		title = strings.TrimSuffix(document, filepath.Ext(document))
+	}
+
+	stream, err := sse.NewWriter(w)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	var allCards []utils.Flashcard
+	deckId := uuid.New().String()
+	owner := middleware.UserId(r)
+
+	// Guards allCards against the heartbeat's reads
+	var cardsMu sync.Mutex
+
+	stream.Send("status", map[string]interface{}{
+		"message":  fmt.Sprintf("Generating cards from %d chunks...", len(chunks)),
+		"progress": 1,
+		"chunks":   len(chunks),
+	})
+
+	stopHeartbeat := stream.StartHeartbeat(sse.DEFAULT_HEARTBEAT_INTERVAL, func() any {
+		cardsMu.Lock()
+		defer cardsMu.Unlock()
+
+		return map[string]interface{}{
+			"cards": len(allCards),
+			"time":  time.Now().Unix(),
+		}
+	})
+	defer stopHeartbeat()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	for _, chunk := range chunks {
+		if ctx.Err() != nil {
+			log.Println("Client disconnected, stopping document generation")
+			return
+		}
+
+		chunkPrompt, chunkVersion, err := registry.RenderPreferred(prompts.DocumentChunk, version, map[string]any{
+			"Count":   cardsPerChunk,
+			"Title":   title,
+			"Heading": chunk.Heading,
+			"Text":    chunk.Text,
+		})
+		if err != nil {
+			stream.Error("Error building chunk prompt", err)
+			return
+		}
+
+		messages := []utils.Message{
+			{
+				Role:    "system",
+				Content: prompt,
+			},
+			{
+				Role:    "user",
+				Content: chunkPrompt,
+			},
+		}
+
+		cards, errc := utils.MakeOpenAIFlashcardStreamRequest(ctx, messages, cardType)
+		for card := range cards {
+			card.Uuid = uuid.New().String()
+			card.Deck = deckId
+			card.Owner = owner
+			card.Document = document
+			card.Chunk = chunk.Index
+			card.Templates = append(slices.Clone(templates), prompts.Id(prompts.DocumentChunk, chunkVersion))
+			card = card.Stamp(utils.SOURCE_DOCUMENT)
+
+			expanded, err := expandCard(card)
+			if err != nil {
+				log.Println("Skipping generated card:", err)
+				continue
+			}
+
+			err = queueCards(title, expanded)
+			if err != nil {
+				stream.Error("Error saving cards", err)
+				return
+			}
+
+			for _, card := range expanded {
+				stream.Send("card", card)
+			}
+
+			cardsMu.Lock()
+			allCards = append(allCards, expanded...)
+			cardsMu.Unlock()
+		}
+
+		if err := <-errc; err != nil {
+			stream.Error(fmt.Sprintf("Error generating cards for chunk %d", chunk.Index), err)
+			return
+		}
+
+		stream.Send("status", map[string]interface{}{
+			"message":  fmt.Sprintf("%d of %d chunks processed, %d cards generated", chunk.Index, len(chunks), len(allCards)),
+			"progress": float64(chunk.Index) / float64(len(chunks)) * 100,
+			"chunk":    chunk.Index,
+		})
+	}
+
+	// The client already has the document, so chunks are listed without
+	// their text
+	chunkHeadings := []utils.DocumentChunk{}
+	for _, chunk := range chunks {
+		chunkHeadings = append(chunkHeadings, utils.DocumentChunk{Index: chunk.Index, Heading: chunk.Heading})
+	}
+
+	stream.Send("complete", map[string]interface{}{
+		"message":  "Deck generation complete",
+		"progress": 100,
+		"chunks":   chunkHeadings,
+		"deck": utils.FlashcardDeck{
+			Id:    deckId,
+			Cards: allCards,
+			Title: title,
+		},
+	})
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"sanctum/middleware"
+	"sanctum/utils"
+)
+
+// gradeError maps a grading failure to a status code and client-facing message
+func gradeError(err error) (int, string) {
+	switch {
+	case errors.Is(err, utils.ErrCardIndexing):
+		return http.StatusAccepted, "Card is still being indexed, try again shortly"
+	case errors.Is(err, utils.ErrCardIndexFailed):
+		return http.StatusInternalServerError, "Card could not be indexed"
+	case errors.Is(err, utils.ErrCardNotFound):
+		return http.StatusNotFound, "Card not found"
+	}
+
+	return http.StatusInternalServerError, fmt.Sprintf("Error grading answer: %v", err)
+}
+
+// GradeBatchHandler grades a whole quiz session at once. Every item gets its
+// own status, so the response is 200 even if some items couldn't be graded.
+func GradeBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req utils.BatchGradeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if len(req.Items) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one item must be provided")
+		return
+	}
+
+	if len(req.Items) > utils.MAX_BATCH_GRADE {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("At most %d items can be graded at once", utils.MAX_BATCH_GRADE))
+		return
+	}
+
+	items := make([]utils.BatchGradeItem, len(req.Items))
+	gradeRequests := []utils.GradeRequest{}
+	policies := []utils.GradingPolicy{}
+	positions := []int{}
+
+	defaultPolicy := utils.DefaultGradingPolicy()
+	for i, gradeRequest := range req.Items {
+		items[i].Uuid = gradeRequest.Uuid
+
+		if gradeRequest.Uuid == "" || gradeRequest.Answer == "" {
+			items[i].Status = "error"
+			items[i].Error = "A uuid and an answer must be provided"
+			continue
+		}
+
+		policy, err := defaultPolicy.WithOverrides(gradeRequest)
+		if err != nil {
+			items[i].Status = "error"
+			items[i].Error = err.Error()
+			continue
+		}
+
+		gradeRequests = append(gradeRequests, gradeRequest)
+		policies = append(policies, policy)
+		positions = append(positions, i)
+	}
+
+	if len(gradeRequests) > 0 {
+		pc, err := utils.GetPineconeClient()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error connecting to pinecone client")
+			return
+		}
+
+		results, errs := utils.GradeBatch(pc, middleware.UserId(r), gradeRequests, policies)
+		for j, i := range positions {
+			switch {
+			case errs[j] == nil:
+				items[i].Status = "graded"
+				items[i].Result = &results[j]
+			case errors.Is(errs[j], utils.ErrCardIndexing):
+				items[i].Status = "indexing"
+				_, items[i].Error = gradeError(errs[j])
+			default:
+				items[i].Status = "error"
+				_, items[i].Error = gradeError(errs[j])
+			}
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]any{
+		"items": items,
+	})
+}
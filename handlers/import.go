@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"sanctum/middleware"
+	"sanctum/utils"
+)
+
+const MAX_IMPORT_SIZE = 32 << 20
+
+// queueDecks queues each imported deck's cards under its title
+func queueDecks(decks []utils.FlashcardDeck) error {
+	for _, deck := range decks {
+		if err := queueCards(deck.Title, deck.Cards); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readUploads returns every file uploaded in the multipart "file" fields,
+// with zips replaced by their contents that have one of extensions
+func readUploads(r *http.Request, extensions ...string) ([]utils.ArchiveFile, error) {
+	uploads := []utils.ArchiveFile{}
+	for _, header := range r.MultipartForm.File["file"] {
+		file, err := header.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s: %v", header.Filename, err)
+		}
+
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", header.Filename, err)
+		}
+
+		if strings.EqualFold(path.Ext(header.Filename), ".zip") {
+			files, err := utils.ReadArchive(data, extensions...)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", header.Filename, err)
+			}
+			uploads = append(uploads, files...)
+			continue
+		}
+
+		uploads = append(uploads, utils.ArchiveFile{Name: header.Filename, Data: data})
+	}
+
+	return uploads, nil
+}
+
+// ImportMarkdownHandler serves POST /import/markdown. It takes one or more
+// .md files, or zips of a notes vault, in multipart "file" fields and makes a
+// deck of each file's inline flashcards. Lines that can't be parsed are
+// reported per file rather than failing the import.
+func ImportMarkdownHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_IMPORT_SIZE)
+	if err := r.ParseMultipartForm(MAX_IMPORT_SIZE); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid upload, imports can be at most %d bytes", MAX_IMPORT_SIZE))
+		return
+	}
+
+	uploads, err := readUploads(r, ".md", ".markdown")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(uploads) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No Markdown files were uploaded")
+		return
+	}
+
+	owner := middleware.UserId(r)
+
+	reports := []utils.FileImport{}
+	decks := []utils.FlashcardDeck{}
+	imported := 0
+	for _, upload := range uploads {
+		report := utils.FileImport{File: upload.Name}
+
+		cards, parseErrs := utils.ParseMarkdownCards(string(upload.Data))
+		report.Errors = parseErrs
+
+		if len(cards) > 0 {
+			report.Deck = uuid.New().String()
+			report.Title = strings.TrimSuffix(path.Base(upload.Name), path.Ext(upload.Name))
+		}
+
+		deck := utils.FlashcardDeck{Id: report.Deck, Title: report.Title}
+
+		for _, card := range cards {
+			card.Uuid = uuid.New().String()
+			card.Deck = report.Deck
+			card.Owner = owner
+			card.Document = upload.Name
+			card = card.Stamp(utils.SOURCE_MARKDOWN)
+
+			// The parser already checked cloze notes, but a multiple-choice
+			// card's options can still be too close to its answer
+			expanded, err := expandCard(card)
+			if err != nil {
+				report.Errors = append(report.Errors, utils.ParseError{Message: fmt.Sprintf("%q: %v", card.Pattern, err)})
+				continue
+			}
+
+			deck.Cards = append(deck.Cards, expanded...)
+			report.Cards += len(expanded)
+		}
+
+		reports = append(reports, report)
+		decks = append(decks, deck)
+		imported += report.Cards
+	}
+
+	// The outbox embeds and upserts these in batches
+	if err := queueDecks(decks); err != nil {
+		log.Println("Error queueing imported cards:", err)
+		respondWithError(w, http.StatusInternalServerError, "Error saving cards")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]any{
+		"message":  fmt.Sprintf("Imported %d cards from %d files", imported, len(uploads)),
+		"imported": imported,
+		"files":    reports,
+		"status":   utils.OutboxPending,
+	})
+}
+
+// ImportAnkiHandler serves POST /import/anki. It takes one or more .apkg
+// exports in multipart "file" fields and makes a deck of each Anki deck in
+// them, keeping the notes' tags. With history=true, each card's Anki review
+// history is carried over too. Notes that can't be converted are reported
+// by note ID with the deck they're in.
+func ImportAnkiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_IMPORT_SIZE)
+	if err := r.ParseMultipartForm(MAX_IMPORT_SIZE); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid upload, imports can be at most %d bytes", MAX_IMPORT_SIZE))
+		return
+	}
+
+	includeHistory := r.FormValue("history") == "true"
+
+	// An .apkg is itself a zip, so it's read whole rather than unpacked here
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No Anki packages were uploaded")
+		return
+	}
+
+	owner := middleware.UserId(r)
+
+	reports := []utils.FileImport{}
+	decks := []utils.FlashcardDeck{}
+	imported := 0
+	media := 0
+	for _, header := range headers {
+		file, err := header.Open()
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Error opening %s", header.Filename))
+			return
+		}
+
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Error reading %s", header.Filename))
+			return
+		}
+
+		pkg, err := utils.ReadAnkiPackage(data, includeHistory)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("%s: %v", header.Filename, err))
+			return
+		}
+		media += pkg.Media
+
+		for _, deck := range pkg.Decks {
+			report := utils.FileImport{
+				File:   header.Filename,
+				Title:  deck.Name,
+				Cards:  len(deck.Cards),
+				Errors: deck.Skipped,
+			}
+
+			// A deck whose notes were all skipped is only reported
+			if len(deck.Cards) == 0 {
+				reports = append(reports, report)
+				continue
+			}
+			report.Deck = uuid.New().String()
+
+			saved := utils.FlashcardDeck{Id: report.Deck, Title: deck.Name}
+			for _, card := range deck.Cards {
+				if card.Uuid == "" {
+					card.Uuid = uuid.New().String()
+				}
+				card.Deck = report.Deck
+				card.Owner = owner
+				card.Document = header.Filename
+				saved.Cards = append(saved.Cards, card.Stamp(utils.SOURCE_ANKI))
+			}
+
+			reports = append(reports, report)
+			decks = append(decks, saved)
+		}
+
+		// Notes without cards in any deck are reported against the package
+		if len(pkg.Skipped) > 0 || len(pkg.Decks) == 0 {
+			reports = append(reports, utils.FileImport{File: header.Filename, Errors: pkg.Skipped})
+		}
+	}
+
+	for _, deck := range decks {
+		imported += len(deck.Cards)
+	}
+
+	if err := queueDecks(decks); err != nil {
+		log.Println("Error queueing imported cards:", err)
+		respondWithError(w, http.StatusInternalServerError, "Error saving cards")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]any{
+		"message":      fmt.Sprintf("Imported %d cards in %d decks", imported, len(decks)),
+		"imported":     imported,
+		"decks":        reports,
+		"mediaSkipped": media,
+		"status":       utils.OutboxPending,
+	})
+}
+
+// ImportTableHandler serves POST /import/csv. It takes a CSV or TSV file
+// with a header row in the multipart "file" field and makes a deck of it.
+// Columns are found by name (see utils.COLUMN_ALIASES) unless "mapping" maps
+// card fields to header names, e.g. {"pattern": "Front", "match": "Back"}.
+// Every row is reported as imported or rejected; rejected rows don't stop
+// the others. The outbox embeds and upserts the cards in large batches.
+func ImportTableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_IMPORT_SIZE)
+	if err := r.ParseMultipartForm(MAX_IMPORT_SIZE); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid upload, imports can be at most %d bytes", MAX_IMPORT_SIZE))
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "A CSV or TSV file must be uploaded in the file field")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error reading file")
+		return
+	}
+
+	delimiter := ','
+	switch r.FormValue("delimiter") {
+	case "":
+		if ext := strings.ToLower(path.Ext(header.Filename)); ext == ".tsv" || ext == ".tab" {
+			delimiter = '\t'
+		}
+	case ",", "comma":
+	case "\t", "tab":
+		delimiter = '\t'
+	case ";", "semicolon":
+		delimiter = ';'
+	default:
+		respondWithError(w, http.StatusBadRequest, "Delimiter must be comma, tab or semicolon")
+		return
+	}
+
+	mapping := map[string]string{}
+	if raw := r.FormValue("mapping"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &mapping); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Mapping must be a JSON object of card fields to column names")
+			return
+		}
+	}
+
+	rows, err := utils.ParseCardTable(data, delimiter, mapping)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid file: %v", err))
+		return
+	}
+
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" {
+		title = strings.TrimSuffix(path.Base(header.Filename), path.Ext(header.Filename))
+	}
+
+	deck := utils.FlashcardDeck{Id: uuid.New().String(), Title: title}
+	owner := middleware.UserId(r)
+	for i := range rows {
+		if rows[i].Card == nil {
+			continue
+		}
+
+		card := *rows[i].Card
+		card.Uuid = uuid.New().String()
+		card.Deck = deck.Id
+		card.Owner = owner
+		card.Document = header.Filename
+
+		rows[i].Uuid = card.Uuid
+		deck.Cards = append(deck.Cards, card.Stamp(utils.SOURCE_IMPORT))
+	}
+
+	if err := queueCards(deck.Title, deck.Cards); err != nil {
+		log.Println("Error queueing imported cards:", err)
+		respondWithError(w, http.StatusInternalServerError, "Error saving cards")
+		return
+	}
+
+	response := map[string]any{
+		"message":  fmt.Sprintf("Imported %d of %d rows", len(deck.Cards), len(rows)),
+		"imported": len(deck.Cards),
+		"rejected": len(rows) - len(deck.Cards),
+		"rows":     rows,
+		"status":   utils.OutboxPending,
+	}
+	if len(deck.Cards) > 0 {
+		response["deck"] = deck.Id
+		response["title"] = deck.Title
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
@@ -2,19 +2,53 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"sanctum/prompts"
+	"sanctum/sse"
 	"sanctum/utils"
+	"strings"
 )
 
 type PromptRequest struct {
-	Prompt string `json:"prompt"`
+	Prompt        string `json:"prompt"`
+	Stream        bool   `json:"stream,omitempty"`
+	PromptVersion string `json:"promptVersion,omitempty"`
 }
 
+// PromptResponse lists the suggested variants. EnhancedPrompt is the
+// balanced variant's prompt, for clients that only want one suggestion.
 type PromptResponse struct {
-	EnhancedPrompt string `json:"enhancedPrompt,omitempty"`
-	Error          string `json:"error,omitempty"`
+	EnhancedPrompt string                `json:"enhancedPrompt,omitempty"`
+	Variants       []utils.PromptVariant `json:"variants,omitempty"`
+	Template       string                `json:"template,omitempty"`
+	Error          string                `json:"error,omitempty"`
 }
 
+func newPromptResponse(variants []utils.PromptVariant, templateId string) PromptResponse {
+	response := PromptResponse{
+		Variants: variants,
+		Template: templateId,
+	}
+
+	for _, variant := range variants {
+		if variant.Kind == utils.VariantBalanced {
+			response.EnhancedPrompt = variant.Prompt
+			break
+		}
+	}
+	if response.EnhancedPrompt == "" && len(variants) > 0 {
+		response.EnhancedPrompt = variants[0].Prompt
+	}
+
+	return response
+}
+
+// PromptSuggestionHandler suggests balanced, narrower, broader and
+// exam-focused rewrites of a study prompt, each with its subtopics and an
+// estimate of how many cards it would take, so the user can pick one before
+// starting a deck generation
 func PromptSuggestionHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -32,26 +66,35 @@ func PromptSuggestionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	registry, err := prompts.Get()
+	if err != nil {
+		http.Error(w, "Error loading prompt templates", http.StatusInternalServerError)
+		return
+	}
+
+	// Versions of the old single-suggestion template still give a single
+	// enhanced prompt, so clients that pinned one keep working
+	if !registry.Has(prompts.PromptVariants, req.PromptVersion) && registry.Has(prompts.PromptSuggestion, req.PromptVersion) {
+		legacyPromptSuggestion(w, r, registry, req)
+		return
+	}
+
+	if req.PromptVersion != "" && !registry.Has(prompts.PromptVariants, req.PromptVersion) {
+		http.Error(w, fmt.Sprintf("Unknown prompt version %s, see /prompts", req.PromptVersion), http.StatusBadRequest)
+		return
+	}
+
+	systemPrompt, version, err := registry.Render(prompts.PromptVariants, req.PromptVersion, nil)
+	if err != nil {
+		http.Error(w, "Error rendering prompt template", http.StatusInternalServerError)
+		return
+	}
+	templateId := prompts.Id(prompts.PromptVariants, version)
+
 	messages := []utils.Message{
 		{
-			Role: "system",
-			Content: `You are an AI assistant that enhances study prompts to create more effective flashcard content. 
-Your task is to take the user's input prompt and expand it into a more detailed, comprehensive version.
-
-Consider:
-- Adding specific subtopics
-- Including relevant terminology
-- Expanding scope where beneficial
-- Adding context and related concepts
-- Ensuring appropriate detail level
-- Breaking down complex topics into manageable parts
-
-Respond with ONLY the enhanced prompt text. Do not include explanations or metadata.
-The enhanced prompt should be a direct replacement for the original, ready to use for flashcard creation.
-
-Example:
-Input: "Ancient Rome"
-Output: "Ancient Rome (753 BCE - 476 CE), including: political structure (Republic and Empire), key historical figures, major battles, social classes, cultural developments, architectural achievements, and the factors leading to its rise and fall"`,
+			Role:    "system",
+			Content: systemPrompt,
 		},
 		{
 			Role:    "user",
@@ -59,10 +102,108 @@ Output: "Ancient Rome (753 BCE - 476 CE), including: political structure (Republ
 		},
 	}
 
+	if req.Stream {
+		streamPromptSuggestion(w, r, messages, templateId)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	variants, err := utils.SuggestPromptVariants(messages)
+	if err != nil {
+		log.Println("Error suggesting prompts:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(PromptResponse{
+			Error: "Error processing request",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(newPromptResponse(variants, templateId))
+}
+
+// streamPromptSuggestion sends each variant over SSE as a "variant" event as
+// soon as it's generated, followed by a "complete" event with all of them
+func streamPromptSuggestion(w http.ResponseWriter, r *http.Request, messages []utils.Message, templateId string) {
+	stream, err := sse.NewWriter(w)
+	if err != nil {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	stopHeartbeat := stream.StartHeartbeat(sse.DEFAULT_HEARTBEAT_INTERVAL, nil)
+	defer stopHeartbeat()
+
+	variantc, errc := utils.StreamPromptVariants(r.Context(), messages)
+
+	variants := []utils.PromptVariant{}
+	for variant := range variantc {
+		variants = append(variants, variant)
+		stream.Send("variant", variant)
+	}
+
+	if err := <-errc; err != nil {
+		stream.Error("Error processing request", err)
+		return
+	}
+
+	stream.Send("complete", newPromptResponse(variants, templateId))
+}
+
+// legacyPromptSuggestion answers a request pinned to a version of the
+// deprecated prompt-suggestion template with the one enhanced prompt it
+// always gave, streamed as "delta" events and a "complete" event if asked
+func legacyPromptSuggestion(w http.ResponseWriter, r *http.Request, registry *prompts.Registry, req PromptRequest) {
+	systemPrompt, version, err := registry.Render(prompts.PromptSuggestion, req.PromptVersion, nil)
+	if err != nil {
+		http.Error(w, "Error rendering prompt template", http.StatusInternalServerError)
+		return
+	}
+	templateId := prompts.Id(prompts.PromptSuggestion, version)
+
+	messages := []utils.Message{
+		{
+			Role:    "system",
+			Content: systemPrompt,
+		},
+		{
+			Role:    "user",
+			Content: req.Prompt,
+		},
+	}
+
+	if req.Stream {
+		stream, err := sse.NewWriter(w)
+		if err != nil {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		stopHeartbeat := stream.StartHeartbeat(sse.DEFAULT_HEARTBEAT_INTERVAL, nil)
+		defer stopHeartbeat()
+
+		deltas, errc := utils.MakeOpenAIChatStreamRequest(r.Context(), messages, nil)
+
+		var enhanced strings.Builder
+		for delta := range deltas {
+			enhanced.WriteString(delta)
+			stream.Send("delta", map[string]string{"content": delta})
+		}
+
+		if err := <-errc; err != nil {
+			stream.Error("Error processing request", err)
+			return
+		}
+
+		stream.Send("complete", PromptResponse{EnhancedPrompt: enhanced.String(), Template: templateId})
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
 	response, err := utils.MakeOpenAIChatRequest(messages, nil)
 	if err != nil {
+		log.Println("Error suggesting prompt:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(PromptResponse{
 			Error: "Error processing request",
@@ -70,7 +211,22 @@ Output: "Ancient Rome (753 BCE - 476 CE), including: political structure (Republ
 		return
 	}
 
-	json.NewEncoder(w).Encode(PromptResponse{
-		EnhancedPrompt: response,
-	})
+	json.NewEncoder(w).Encode(PromptResponse{EnhancedPrompt: response, Template: templateId})
+}
+
+// PromptTemplatesHandler serves GET /prompts, every prompt template name
+// with its versions, oldest first
+func PromptTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	registry, err := prompts.Get()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error loading prompt templates: %v", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]any{"templates": registry.All()})
 }
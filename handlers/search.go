@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"sanctum/middleware"
+	"sanctum/utils"
+)
+
+// cardFilter reads the deck, tag (repeatable), difficulty and source
+// query parameters
+func cardFilter(r *http.Request) (utils.CardFilter, error) {
+	query := r.URL.Query()
+
+	filter := utils.CardFilter{
+		Deck:       query.Get("deck"),
+		Tags:       query["tag"],
+		Difficulty: utils.Difficulty(query.Get("difficulty")),
+		Source:     query.Get("source"),
+	}
+
+	if !filter.Difficulty.Valid() {
+		return filter, fmt.Errorf("difficulty must be easy, medium or hard")
+	}
+
+	return filter, nil
+}
+
+// searchLimit reads the k query parameter, defaulting to DEFAULT_SEARCH_LIMIT
+func searchLimit(r *http.Request) (int, error) {
+	raw := r.URL.Query().Get("k")
+	if raw == "" {
+		return utils.DEFAULT_SEARCH_LIMIT, nil
+	}
+
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > utils.MAX_SEARCH_LIMIT {
+		return 0, fmt.Errorf("k must be between 1 and %d", utils.MAX_SEARCH_LIMIT)
+	}
+
+	return limit, nil
+}
+
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		respondWithError(w, http.StatusBadRequest, "Query cannot be empty")
+		return
+	}
+
+	owner := middleware.UserId(r)
+	if owner == "" {
+		respondWithError(w, http.StatusUnauthorized, "Token has no user, request a new one from /auth")
+		return
+	}
+
+	limit, err := searchLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter, err := cardFilter(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	pc, err := utils.GetPineconeClient()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error connecting to pinecone client")
+		return
+	}
+
+	results, err := pc.SearchCards(query, owner, filter, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error searching cards: %v", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]any{
+		"query":   query,
+		"results": results,
+	})
+}
+
+// RelatedCardsHandler serves GET /cards/{uuid}/related, the "see also" cards
+// for a card across the user's decks, narrowed by the same parameters as search
+func RelatedCardsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	owner := middleware.UserId(r)
+	if owner == "" {
+		respondWithError(w, http.StatusUnauthorized, "Token has no user, request a new one from /auth")
+		return
+	}
+
+	limit, err := searchLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter, err := cardFilter(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	pc, err := utils.GetPineconeClient()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Error connecting to pinecone client")
+		return
+	}
+
+	card, related, err := pc.RelatedCards(r.PathValue("uuid"), owner, filter, limit)
+	if errors.Is(err, utils.ErrCardNotFound) {
+		respondWithError(w, http.StatusNotFound, "Card not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Error finding related cards: %v", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]any{
+		"card":    card.Card,
+		"related": related,
+	})
+}
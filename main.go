@@ -6,15 +6,40 @@ import (
 
 	"sanctum/handlers"
 	"sanctum/middleware"
+	"sanctum/prompts"
+	"sanctum/utils"
 )
 
 func main() {
+	// Open the outbox up front so cards left pending by a previous run get indexed
+	if _, err := utils.GetOutbox(); err != nil {
+		log.Fatal("Error opening card outbox: ", err)
+	}
+
+	// Fail fast on a broken template in SANCTUM_PROMPT_DIR rather than on the first generation
+	if _, err := prompts.Get(); err != nil {
+		log.Fatal("Error loading prompt templates: ", err)
+	}
+
 	http.HandleFunc("/grade", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.GradeHandler)))
+	http.HandleFunc("/grade/batch", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.GradeBatchHandler)))
 	http.HandleFunc("/add-card", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.AddCardHandler)))
 	http.Handle("/remove-card", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.RemoveCardHandler)))
+	http.HandleFunc("/search", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.SearchHandler)))
+	http.HandleFunc("/cards/{uuid}/related", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.RelatedCardsHandler)))
+	http.HandleFunc("/import/markdown", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.ImportMarkdownHandler)))
+	http.HandleFunc("/import/anki", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.ImportAnkiHandler)))
+	http.HandleFunc("/import/csv", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.ImportTableHandler)))
+	http.HandleFunc("/decks/{id}/export", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.ExportDeckHandler)))
+	http.HandleFunc("/decks/{id}/coverage", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.DeckCoverageHandler)))
+	http.HandleFunc("/decks/{id}/coverage/fill", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.FillGapsHandler)))
+	http.HandleFunc("/calibration", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.CalibrationHandler)))
+	http.HandleFunc("/calibration/labels", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.CalibrationLabelsHandler)))
 
 	http.HandleFunc("/auth", middleware.LoggingMiddleware(handlers.AuthHandler))
 	http.HandleFunc("/generate-deck", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.GenerateDeckHandler)))
+	http.HandleFunc("/generate-deck/from-document", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.GenerateFromDocumentHandler)))
+	http.HandleFunc("/prompts", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.PromptTemplatesHandler)))
 	http.HandleFunc("/prompt-suggestion", middleware.LoggingMiddleware(middleware.AuthMiddleware(handlers.PromptSuggestionHandler)))
 
 	log.Println("Server starting on localhost:8080")
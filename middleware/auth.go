@@ -1,12 +1,71 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"github.com/dgrijalva/jwt-go"
 	"net/http"
+	"os"
 	"strings"
 )
 
-var jwtKey = []byte("sanctum_dev")
+type contextKey string
+
+const userIdKey contextKey = "userId"
+
+// JwtKey signs and verifies tokens. /auth must sign with the same key this
+// middleware verifies with, so both read it from here.
+func JwtKey() []byte {
+	if key := os.Getenv("SANCTUM_JWT_KEY"); key != "" {
+		return []byte(key)
+	}
+	return []byte("sanctum_dev")
+}
+
+// Refresh tokens carry this "use" claim. They only renew access through
+// /auth and aren't accepted on other routes.
+const TOKEN_USE_REFRESH = "refresh"
+
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+func parseToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return JwtKey(), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+
+	return claims, nil
+}
+
+// RefreshSubject returns the user a refresh token was issued to, so /auth
+// can issue new tokens for the same user
+func RefreshSubject(tokenString string) (string, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return "", ErrInvalidRefreshToken
+	}
+
+	sub, _ := claims["sub"].(string)
+	if use, _ := claims["use"].(string); use != TOKEN_USE_REFRESH || sub == "" {
+		return "", ErrInvalidRefreshToken
+	}
+
+	return sub, nil
+}
+
+// UserId returns the token subject of an authenticated request, or "" for
+// tokens issued before subjects were added
+func UserId(r *http.Request) string {
+	userId, _ := r.Context().Value(userIdKey).(string)
+	return userId
+}
 
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -22,15 +81,21 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.Parse(bearerToken[1], func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := parseToken(bearerToken[1])
+		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
+		if use, _ := claims["use"].(string); use == TOKEN_USE_REFRESH {
+			http.Error(w, "Refresh tokens can only be used with /auth", http.StatusUnauthorized)
+			return
+		}
+
+		if sub, ok := claims["sub"].(string); ok {
+			r = r.WithContext(context.WithValue(r.Context(), userIdKey, sub))
+		}
+
 		next(w, r)
 	}
 }
@@ -0,0 +1,193 @@
+// Package prompts is a registry of the chat prompts, kept as versioned
+// text/template files. Each template lives at <name>/<version>.tmpl, under
+// templates/ (embedded in the binary) and optionally under the directory in
+// SANCTUM_PROMPT_DIR, whose files add versions. A version is never replaced,
+// so the name@version recorded on a card always identifies the same text.
+// Templates use [[ ]] as delimiters, since cloze prompts are full of {{ }}.
+package prompts
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+//go:embed templates
+var embedded embed.FS
+
+const (
+	DeckBasic         = "deck-basic"
+	DeckCloze         = "deck-cloze"
+	DeckChoice        = "deck-choice"
+	DeckOutline       = "deck-outline"
+	DeckSubtopic      = "deck-subtopic"
+	DeckTopic         = "deck-topic"
+	DeckExpand        = "deck-expand"
+	CoverageLabels    = "coverage-labels"
+	DocumentGrounding = "document-grounding"
+	DocumentChunk     = "document-chunk"
+	PromptVariants    = "prompt-variants"
+
+	// Deprecated: PromptSuggestion is the single enhanced prompt that
+	// /prompt-suggestion returned before it suggested variants. It's only
+	// kept for clients that pin its v1; use PromptVariants.
+	PromptSuggestion = "prompt-suggestion"
+)
+
+const TEMPLATE_EXTENSION = ".tmpl"
+
+type Registry struct {
+	templates map[string]map[string]*template.Template
+}
+
+var (
+	registryInstance *Registry
+	registryOnce     sync.Once
+	registryErr      error
+)
+
+// Get returns the registry of embedded templates plus any in
+// SANCTUM_PROMPT_DIR
+func Get() (*Registry, error) {
+	registryOnce.Do(func() {
+		registryInstance = &Registry{templates: map[string]map[string]*template.Template{}}
+
+		templates, err := fs.Sub(embedded, "templates")
+		if err == nil {
+			err = registryInstance.Load(templates)
+		}
+		if err == nil {
+			if dir := os.Getenv("SANCTUM_PROMPT_DIR"); dir != "" {
+				err = registryInstance.Load(os.DirFS(dir))
+			}
+		}
+
+		if err != nil {
+			registryInstance, registryErr = nil, err
+		}
+	})
+
+	return registryInstance, registryErr
+}
+
+// Load parses every <name>/<version>.tmpl in fsys into the registry. It
+// fails if fsys has a version the registry already has.
+func (r *Registry) Load(fsys fs.FS) error {
+	files, err := fs.Glob(fsys, "*/*"+TEMPLATE_EXTENSION)
+	if err != nil {
+		return fmt.Errorf("error listing prompt templates: %v", err)
+	}
+
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return fmt.Errorf("error reading prompt template %s: %v", file, err)
+		}
+
+		name := path.Dir(file)
+		version := strings.TrimSuffix(path.Base(file), TEMPLATE_EXTENSION)
+		if r.Has(name, version) {
+			return fmt.Errorf("prompt template %s already exists; add a new version instead of replacing it", Id(name, version))
+		}
+
+		tmpl, err := template.New(Id(name, version)).Delims("[[", "]]").Option("missingkey=error").Parse(string(data))
+		if err != nil {
+			return fmt.Errorf("error parsing prompt template %s: %v", file, err)
+		}
+
+		if r.templates[name] == nil {
+			r.templates[name] = map[string]*template.Template{}
+		}
+		r.templates[name][version] = tmpl
+	}
+
+	return nil
+}
+
+// Id is how a template version is recorded on the cards it produced
+func Id(name string, version string) string {
+	return name + "@" + version
+}
+
+// versionLess orders v2 before v10, falling back to plain string order for
+// versions that aren't a number with an optional v prefix
+func versionLess(a string, b string) bool {
+	an, aErr := strconv.Atoi(strings.TrimPrefix(a, "v"))
+	bn, bErr := strconv.Atoi(strings.TrimPrefix(b, "v"))
+	if aErr == nil && bErr == nil {
+		return an < bn
+	}
+	if (aErr == nil) != (bErr == nil) {
+		return aErr == nil
+	}
+	return a < b
+}
+
+// Versions returns name's versions, oldest first
+func (r *Registry) Versions(name string) []string {
+	versions := []string{}
+	for version := range r.templates[name] {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versionLess(versions[i], versions[j]) })
+
+	return versions
+}
+
+// All returns every template name with its versions
+func (r *Registry) All() map[string][]string {
+	all := map[string][]string{}
+	for name := range r.templates {
+		all[name] = r.Versions(name)
+	}
+	return all
+}
+
+// Has reports whether name has version
+func (r *Registry) Has(name string, version string) bool {
+	_, ok := r.templates[name][version]
+	return ok
+}
+
+// Render executes name at version, or at its latest version if version is
+// empty, and returns the text along with the version used
+func (r *Registry) Render(name string, version string, data any) (string, string, error) {
+	versions := r.Versions(name)
+	if len(versions) == 0 {
+		return "", "", fmt.Errorf("no prompt template named %s", name)
+	}
+
+	if version == "" {
+		version = versions[len(versions)-1]
+	}
+
+	tmpl, ok := r.templates[name][version]
+	if !ok {
+		return "", "", fmt.Errorf("prompt template %s has no version %s; available versions are %s", name, version, strings.Join(versions, ", "))
+	}
+
+	var text strings.Builder
+	if err := tmpl.Execute(&text, data); err != nil {
+		return "", "", fmt.Errorf("error rendering prompt template %s: %v", Id(name, version), err)
+	}
+
+	return strings.TrimSpace(text.String()), version, nil
+}
+
+// RenderPreferred renders name at version if it has that version and at its
+// latest otherwise, so one requested version can select a whole set of
+// templates that weren't all revised together. The version returned is the
+// one used, which callers record since it may not be the one asked for.
+func (r *Registry) RenderPreferred(name string, version string, data any) (string, string, error) {
+	if !r.Has(name, version) {
+		version = ""
+	}
+	return r.Render(name, version, data)
+}
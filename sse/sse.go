@@ -0,0 +1,135 @@
+package sse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DEFAULT_HEARTBEAT_INTERVAL = 15 * time.Second
+
+// How long clients should wait before reconnecting, sent as the stream's retry hint
+const RETRY_HINT = 3 * time.Second
+
+// Writer frames server-sent events on a response. It's safe for concurrent
+// use, so a heartbeat can run alongside the handler's own events.
+type Writer struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	mu      sync.Mutex
+	nextId  int
+}
+
+type ErrorEvent struct {
+	Message string `json:"message"`
+}
+
+// NewWriter sets the event-stream headers and sends the retry hint. Handlers
+// should finish validating the request first: once this returns the status
+// code is committed, and failures have to be reported with Error.
+func NewWriter(w http.ResponseWriter) (*Writer, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming unsupported")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+
+	s := &Writer{
+		w:       w,
+		flusher: flusher,
+		nextId:  1,
+	}
+
+	fmt.Fprintf(w, "retry: %d\n\n", RETRY_HINT.Milliseconds())
+	flusher.Flush()
+
+	return s, nil
+}
+
+// Send writes an event with the next event ID and data encoded as JSON
+func (s *Writer) Send(event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Error marshaling %s event: %v", event, err)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = fmt.Fprintf(s.w, "id: %d\nevent: %s\ndata: %s\n\n", s.nextId, event, payload)
+	s.nextId += 1
+	s.flusher.Flush()
+
+	return err
+}
+
+// Error sends an error event. err is logged but not sent to the client.
+func (s *Writer) Error(message string, err error) error {
+	if err != nil {
+		log.Printf("ERROR: %s: %v", message, err)
+	} else {
+		log.Printf("ERROR: %s", message)
+	}
+
+	return s.Send("error", ErrorEvent{Message: message})
+}
+
+// comment writes an SSE comment line, which clients ignore but which keeps
+// proxies from timing out an idle connection
+func (s *Writer) comment(text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := fmt.Fprintf(s.w, ": %s\n\n", text)
+	s.flusher.Flush()
+
+	return err
+}
+
+// StartHeartbeat sends a comment heartbeat every interval until the returned
+// stop function is called, which must happen before the handler returns. If
+// payload is non-nil, a "heartbeat" event with its result is sent as well,
+// for clients that want to show liveness.
+func (s *Writer) StartHeartbeat(interval time.Duration, payload func() any) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				if err := s.comment(fmt.Sprintf("heartbeat %d", now.Unix())); err != nil {
+					return
+				}
+
+				if payload != nil {
+					s.Send("heartbeat", payload())
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Wait for the goroutine so nothing writes after the handler returns
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-finished
+	}
+}
@@ -0,0 +1,702 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"html"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Anki note model types
+const (
+	ANKI_MODEL_STANDARD = 0
+	ANKI_MODEL_CLOZE    = 1
+)
+
+// ReviewHistory summarises a card's reviews in the app it was imported from,
+// so a scheduler can pick up where that app left off. Interval is in days.
+type ReviewHistory struct {
+	Reviews    int     `json:"reviews"`
+	Lapses     int     `json:"lapses"`
+	Interval   int     `json:"interval"`
+	Ease       float32 `json:"ease,omitempty"`
+	LastReview int64   `json:"lastReview,omitempty"`
+}
+
+// AnkiDeck is one deck of a package, with the notes in it that couldn't be
+// converted
+type AnkiDeck struct {
+	Name    string
+	Cards   []Flashcard
+	Skipped []ParseError
+}
+
+// AnkiImport is what was read from a package: its decks, the notes that
+// couldn't be converted and have no cards in any deck, and how many media
+// references were dropped, since cards are text only
+type AnkiImport struct {
+	Decks   []AnkiDeck
+	Skipped []ParseError
+	Media   int
+}
+
+type ankiModel struct {
+	Name   string `json:"name"`
+	Type   int    `json:"type"`
+	Fields []struct {
+		Name string `json:"name"`
+		Ord  int    `json:"ord"`
+	} `json:"flds"`
+	Templates []struct {
+		Name     string `json:"name"`
+		Ord      int    `json:"ord"`
+		Question string `json:"qfmt"`
+		Answer   string `json:"afmt"`
+	} `json:"tmpls"`
+}
+
+type ankiNote struct {
+	id     int64
+	model  *ankiModel
+	fields map[string]string
+	tags   []string
+}
+
+var (
+	ankiMediaPattern   = regexp.MustCompile(`(?i)<img\b[^>]*>|\[sound:[^\]]*\]`)
+	ankiAnswerPattern  = regexp.MustCompile(`(?is)^.*<hr id=["']?answer["']?\s*/?>`)
+	ankiSectionPattern = regexp.MustCompile(`(?s)\{\{([#^])([^}]+)\}\}(.*?)\{\{/([^}]+)\}\}`)
+	ankiFieldPattern   = regexp.MustCompile(`\{\{([^#^/}][^}]*)\}\}`)
+)
+
+// ankiFieldText turns a field's HTML into plain text, counting and dropping
+// images and sounds
+func ankiFieldText(value string, media *int) string {
+	*media += len(ankiMediaPattern.FindAllString(value, -1))
+	value = ankiMediaPattern.ReplaceAllString(value, "")
+
+	value = htmlHiddenPattern.ReplaceAllString(value, "")
+	value = htmlBlockPattern.ReplaceAllString(value, "\n")
+	value = htmlTagPattern.ReplaceAllString(value, "")
+	value = html.UnescapeString(value)
+
+	lines := []string{}
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// renderAnkiTemplate fills in a card template the way Anki does for the
+// parts that matter to text: field references (with or without a filter
+// such as text: or type:), and {{#Field}}/{{^Field}} sections
+func renderAnkiTemplate(template string, fields map[string]string) string {
+	template = ankiSectionPattern.ReplaceAllStringFunc(template, func(section string) string {
+		match := ankiSectionPattern.FindStringSubmatch(section)
+		name := strings.TrimSpace(match[2])
+		if name != strings.TrimSpace(match[4]) {
+			return section
+		}
+
+		present := strings.TrimSpace(fields[name]) != ""
+		if present == (match[1] == "#") {
+			return match[3]
+		}
+		return ""
+	})
+
+	return ankiFieldPattern.ReplaceAllStringFunc(template, func(reference string) string {
+		name := strings.TrimSpace(ankiFieldPattern.FindStringSubmatch(reference)[1])
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			name = name[i+1:]
+		}
+		if name == "FrontSide" {
+			return ""
+		}
+		return fields[name]
+	})
+}
+
+// ReadAnkiPackage reads an .apkg export. Standard notes become one card per
+// Anki card, rendered from the card's template, so basic-and-reversed notes
+// give both directions; cloze notes are already expanded, one card per
+// deletion with UUIDs set. With includeHistory, each card's review counts,
+// interval and ease are carried over in History.
+func ReadAnkiPackage(data []byte, includeHistory bool) (*AnkiImport, error) {
+	files, err := ReadArchive(data, ".anki2", ".anki21", ".anki21b")
+	if err != nil {
+		return nil, err
+	}
+
+	collections := map[string][]byte{}
+	for _, file := range files {
+		collections[file.Name] = file.Data
+	}
+
+	// Newer exports also contain a placeholder collection.anki2 telling old
+	// clients to upgrade, so the newest readable collection wins
+	collection, ok := collections["collection.anki21"]
+	if !ok {
+		if _, compressed := collections["collection.anki21b"]; compressed {
+			return nil, fmt.Errorf("package uses the newest Anki format; export it again with \"Support older Anki versions\" checked")
+		}
+		if collection, ok = collections["collection.anki2"]; !ok {
+			return nil, fmt.Errorf("package has no Anki collection")
+		}
+	}
+
+	// The driver needs a file to open
+	tmp, err := os.CreateTemp("", "sanctum-anki-*.db")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary collection: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(collection)
+	tmp.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error writing temporary collection: %v", err)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+tmp.Name()+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("error opening collection: %v", err)
+	}
+	defer db.Close()
+
+	return readAnkiCollection(db, includeHistory)
+}
+
+func readAnkiCollection(db *sql.DB, includeHistory bool) (*AnkiImport, error) {
+	var modelsJSON, decksJSON string
+	err := db.QueryRow("SELECT models, decks FROM col").Scan(&modelsJSON, &decksJSON)
+	if err != nil {
+		return nil, fmt.Errorf("error reading collection: %v", err)
+	}
+
+	models := map[string]*ankiModel{}
+	if err := json.Unmarshal([]byte(modelsJSON), &models); err != nil || len(models) == 0 {
+		return nil, fmt.Errorf("collection has no readable note types; export it again with \"Support older Anki versions\" checked")
+	}
+
+	deckNames := map[string]struct {
+		Name string `json:"name"`
+	}{}
+	if err := json.Unmarshal([]byte(decksJSON), &deckNames); err != nil {
+		return nil, fmt.Errorf("error parsing decks: %v", err)
+	}
+
+	result := &AnkiImport{}
+
+	notes := map[int64]*ankiNote{}
+	unreadable := map[int64]ParseError{}
+	rows, err := db.Query("SELECT id, mid, tags, flds FROM notes")
+	if err != nil {
+		return nil, fmt.Errorf("error reading notes: %v", err)
+	}
+
+	for rows.Next() {
+		var id, modelId int64
+		var tags, fields string
+		if err := rows.Scan(&id, &modelId, &tags, &fields); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error reading notes: %v", err)
+		}
+
+		model, ok := models[fmt.Sprint(modelId)]
+		if !ok {
+			// Reported against the deck of its first card, if it has any
+			unreadable[id] = ParseError{Note: id, Message: "note type is missing from the collection"}
+			continue
+		}
+
+		note := &ankiNote{
+			id:     id,
+			model:  model,
+			fields: map[string]string{},
+			tags:   strings.Fields(tags),
+		}
+
+		values := strings.Split(fields, "\x1f")
+		for _, field := range model.Fields {
+			if field.Ord < len(values) {
+				note.fields[field.Name] = values[field.Ord]
+			}
+		}
+
+		notes[id] = note
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading notes: %v", err)
+	}
+
+	history := map[int64]*ReviewHistory{}
+	if includeHistory {
+		history, err = readAnkiHistory(db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	type ankiCard struct {
+		id, note, deck int64
+		ord            int
+	}
+
+	cards := []ankiCard{}
+	rows, err = db.Query("SELECT id, nid, did, ord FROM cards ORDER BY nid, ord")
+	if err != nil {
+		return nil, fmt.Errorf("error reading cards: %v", err)
+	}
+
+	for rows.Next() {
+		var card ankiCard
+		if err := rows.Scan(&card.id, &card.note, &card.deck, &card.ord); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error reading cards: %v", err)
+		}
+		cards = append(cards, card)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading cards: %v", err)
+	}
+
+	// A cloze note has one Anki card per deletion index, which is where its
+	// review history lives
+	clozeHistory := map[int64]map[int]*ReviewHistory{}
+	for _, card := range cards {
+		if clozeHistory[card.note] == nil {
+			clozeHistory[card.note] = map[int]*ReviewHistory{}
+		}
+		clozeHistory[card.note][card.ord+1] = history[card.id]
+	}
+
+	decks := map[int64]*AnkiDeck{}
+	deckOrder := []int64{}
+	expanded := map[int64]bool{}
+
+	for _, card := range cards {
+		if expanded[card.note] {
+			continue
+		}
+
+		note, ok := notes[card.note]
+		skipped, isUnreadable := unreadable[card.note]
+		if !ok && !isUnreadable {
+			continue
+		}
+
+		deck, ok := decks[card.deck]
+		if !ok {
+			name := deckNames[fmt.Sprint(card.deck)].Name
+			if name == "" {
+				name = "Imported"
+			}
+			deck = &AnkiDeck{Name: name, Skipped: []ParseError{}}
+			decks[card.deck] = deck
+			deckOrder = append(deckOrder, card.deck)
+		}
+
+		if isUnreadable {
+			deck.Skipped = append(deck.Skipped, skipped)
+			delete(unreadable, card.note)
+			continue
+		}
+
+		if note.model.Type == ANKI_MODEL_CLOZE {
+			expanded[card.note] = true
+
+			clozeCards, err := ankiClozeCards(note, &result.Media)
+			if err != nil {
+				deck.Skipped = append(deck.Skipped, ParseError{Note: note.id, Message: err.Error()})
+				continue
+			}
+
+			for _, clozeCard := range clozeCards {
+				clozeCard.History = clozeHistory[card.note][clozeCard.Cloze]
+				deck.Cards = append(deck.Cards, clozeCard)
+			}
+			continue
+		}
+
+		flashcard, err := ankiStandardCard(note, card.ord, &result.Media)
+		if err == nil {
+			err = flashcard.Validate()
+		}
+		if err != nil {
+			deck.Skipped = append(deck.Skipped, ParseError{Note: note.id, Message: err.Error()})
+			continue
+		}
+
+		flashcard.History = history[card.id]
+		deck.Cards = append(deck.Cards, flashcard)
+	}
+
+	byNote := func(skipped []ParseError) {
+		sort.Slice(skipped, func(i, j int) bool { return skipped[i].Note < skipped[j].Note })
+	}
+
+	for _, deckId := range deckOrder {
+		deck := decks[deckId]
+		if len(deck.Cards) > 0 || len(deck.Skipped) > 0 {
+			byNote(deck.Skipped)
+			result.Decks = append(result.Decks, *deck)
+		}
+	}
+
+	result.Skipped = []ParseError{}
+	for _, skipped := range unreadable {
+		result.Skipped = append(result.Skipped, skipped)
+	}
+	byNote(result.Skipped)
+
+	return result, nil
+}
+
+// ankiStandardCard renders the note's ord-th template into a card. The answer
+// side is whatever the back template adds after the front.
+func ankiStandardCard(note *ankiNote, ord int, media *int) (Flashcard, error) {
+	for _, template := range note.model.Templates {
+		if template.Ord != ord {
+			continue
+		}
+
+		answer := ankiAnswerPattern.ReplaceAllString(template.Answer, "")
+
+		card := Flashcard{
+			Pattern: ankiFieldText(renderAnkiTemplate(template.Question, note.fields), media),
+			Match:   ankiFieldText(renderAnkiTemplate(answer, note.fields), media),
+			Tags:    note.tags,
+		}
+
+		if card.Pattern == "" || card.Match == "" {
+			return card, fmt.Errorf("%s card %q has an empty side once media is removed", note.model.Name, template.Name)
+		}
+
+		return card, nil
+	}
+
+	return Flashcard{}, fmt.Errorf("%s has no card template %d", note.model.Name, ord)
+}
+
+// ankiClozeCards expands a cloze note. Anki keeps the cloze text in the
+// model's first field, and anything in a second field (usually "Back Extra")
+// becomes the card's notes.
+func ankiClozeCards(note *ankiNote, media *int) ([]Flashcard, error) {
+	fields := append(note.model.Fields[:0:0], note.model.Fields...)
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Ord < fields[j].Ord })
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%s has no fields", note.model.Name)
+	}
+
+	card := Flashcard{
+		Type: CardCloze,
+		Text: ankiFieldText(note.fields[fields[0].Name], media),
+		Tags: note.tags,
+	}
+	if len(fields) > 1 {
+		card.Notes = ankiFieldText(note.fields[fields[1].Name], media)
+	}
+
+	if err := card.Validate(); err != nil {
+		return nil, err
+	}
+
+	return ExpandCloze(card)
+}
+
+// readAnkiHistory summarises every card's reviews by Anki card ID. Anki
+// stores intervals under a day as negative seconds and ease in permille.
+func readAnkiHistory(db *sql.DB) (map[int64]*ReviewHistory, error) {
+	rows, err := db.Query(`SELECT c.id, c.reps, c.lapses, c.ivl, c.factor, COALESCE(MAX(r.id), 0)
+		FROM cards c LEFT JOIN revlog r ON r.cid = c.id
+		GROUP BY c.id`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading review history: %v", err)
+	}
+	defer rows.Close()
+
+	history := map[int64]*ReviewHistory{}
+	for rows.Next() {
+		var cardId, lastReview int64
+		var reps, lapses, interval, factor int
+		if err := rows.Scan(&cardId, &reps, &lapses, &interval, &factor, &lastReview); err != nil {
+			return nil, fmt.Errorf("error reading review history: %v", err)
+		}
+
+		if reps == 0 {
+			continue
+		}
+
+		history[cardId] = &ReviewHistory{
+			Reviews:    reps,
+			Lapses:     lapses,
+			Interval:   max(interval, 0),
+			Ease:       float32(factor) / 1000,
+			LastReview: lastReview / 1000,
+		}
+	}
+
+	return history, rows.Err()
+}
+
+// Schema version 11 is the legacy collection format every Anki release can
+// import
+const ankiSchema = `
+CREATE TABLE col (
+	id integer primary key, crt integer not null, mod integer not null, scm integer not null,
+	ver integer not null, dty integer not null, usn integer not null, ls integer not null,
+	conf text not null, models text not null, decks text not null, dconf text not null, tags text not null
+);
+CREATE TABLE notes (
+	id integer primary key, guid text not null, mid integer not null, mod integer not null,
+	usn integer not null, tags text not null, flds text not null, sfld integer not null,
+	csum integer not null, flags integer not null, data text not null
+);
+CREATE TABLE cards (
+	id integer primary key, nid integer not null, did integer not null, ord integer not null,
+	mod integer not null, usn integer not null, type integer not null, queue integer not null,
+	due integer not null, ivl integer not null, factor integer not null, reps integer not null,
+	lapses integer not null, left integer not null, odue integer not null, odid integer not null,
+	flags integer not null, data text not null
+);
+CREATE TABLE revlog (
+	id integer primary key, cid integer not null, usn integer not null, ease integer not null,
+	ivl integer not null, lastIvl integer not null, factor integer not null, time integer not null,
+	type integer not null
+);
+CREATE TABLE graves (usn integer not null, oid integer not null, type integer not null);
+CREATE INDEX ix_notes_usn ON notes (usn);
+CREATE INDEX ix_cards_usn ON cards (usn);
+CREATE INDEX ix_revlog_usn ON revlog (usn);
+CREATE INDEX ix_cards_nid ON cards (nid);
+CREATE INDEX ix_cards_sched ON cards (did, queue, due);
+CREATE INDEX ix_revlog_cid ON revlog (cid);
+CREATE INDEX ix_notes_csum ON notes (csum);
+`
+
+const ankiCSS = `.card { font-family: arial; font-size: 20px; text-align: center; color: black; background-color: white; }`
+
+// ankiFieldHTML escapes text for an Anki field, which is HTML
+func ankiFieldHTML(text string) string {
+	return strings.ReplaceAll(html.EscapeString(strings.TrimSpace(text)), "\n", "<br>")
+}
+
+// ankiNoteFields renders a card as the Front and Back of a basic note. Every
+// card type exports this way, with multiple-choice options listed on the
+// front and accepted answers and notes on the back.
+func ankiNoteFields(card Flashcard) (string, string) {
+	front := ankiFieldHTML(card.Pattern)
+	if len(card.Options) > 0 {
+		options := []string{}
+		for _, option := range card.Options {
+			options = append(options, "<li>"+ankiFieldHTML(option)+"</li>")
+		}
+		front += "<ul>" + strings.Join(options, "") + "</ul>"
+	}
+
+	back := ankiFieldHTML(card.Match)
+	if len(card.Accepted) > 0 {
+		back += "<br><br>Also accepted: " + ankiFieldHTML(strings.Join(card.Accepted, LIST_SEPARATOR))
+	}
+	if card.Notes != "" {
+		back += "<br><br>" + ankiFieldHTML(card.Notes)
+	}
+
+	return front, back
+}
+
+// ankiChecksum is the first 8 hex digits of the SHA-1 of the note's sort
+// field, which Anki uses to find duplicates
+func ankiChecksum(field string) int64 {
+	var media int
+	sum := sha1.Sum([]byte(ankiFieldText(field, &media)))
+	return int64(binary.BigEndian.Uint32(sum[:4]))
+}
+
+// WriteAnkiPackage builds an .apkg holding deck as new cards of a basic
+// Front/Back note type. Note GUIDs are the cards' UUIDs, so importing the
+// same export twice updates notes rather than duplicating them.
+func WriteAnkiPackage(deck FlashcardDeck) ([]byte, error) {
+	now := time.Now()
+	base := now.UnixMilli()
+	modelId := base
+	deckId := base + 1
+
+	title := deck.Title
+	if title == "" {
+		title = "Sanctum"
+	}
+
+	models := map[string]any{
+		fmt.Sprint(modelId): map[string]any{
+			"id":    modelId,
+			"name":  "Sanctum Basic",
+			"type":  ANKI_MODEL_STANDARD,
+			"mod":   now.Unix(),
+			"usn":   -1,
+			"sortf": 0,
+			"did":   deckId,
+			"tmpls": []any{map[string]any{
+				"name":  "Card 1",
+				"ord":   0,
+				"qfmt":  "{{Front}}",
+				"afmt":  "{{FrontSide}}\n\n<hr id=answer>\n\n{{Back}}",
+				"did":   nil,
+				"bqfmt": "",
+				"bafmt": "",
+			}},
+			"flds": []any{
+				map[string]any{"name": "Front", "ord": 0, "sticky": false, "rtl": false, "font": "Arial", "size": 20, "media": []any{}},
+				map[string]any{"name": "Back", "ord": 1, "sticky": false, "rtl": false, "font": "Arial", "size": 20, "media": []any{}},
+			},
+			"css":       ankiCSS,
+			"latexPre":  "\\documentclass[12pt]{article}\n\\special{papersize=3in,5in}\n\\usepackage[utf8]{inputenc}\n\\usepackage{amssymb,amsmath}\n\\pagestyle{empty}\n\\setlength{\\parindent}{0in}\n\\begin{document}\n",
+			"latexPost": "\\end{document}",
+			"req":       []any{[]any{0, "any", []any{0}}},
+			"tags":      []any{},
+			"vers":      []any{},
+		},
+	}
+
+	ankiDeck := func(id int64, name string) map[string]any {
+		return map[string]any{
+			"id": id, "name": name, "desc": "", "mod": now.Unix(), "usn": -1,
+			"collapsed": false, "browserCollapsed": false, "dyn": 0, "conf": 1,
+			"extendNew": 10, "extendRev": 50,
+			"newToday": []any{0, 0}, "revToday": []any{0, 0}, "lrnToday": []any{0, 0}, "timeToday": []any{0, 0},
+		}
+	}
+	decks := map[string]any{
+		"1":                ankiDeck(1, "Default"),
+		fmt.Sprint(deckId): ankiDeck(deckId, title),
+	}
+
+	dconf := map[string]any{
+		"1": map[string]any{
+			"id": 1, "name": "Default", "mod": 0, "usn": 0, "maxTaken": 60, "autoplay": true, "timer": 0, "replayq": true, "dyn": false,
+			"new":   map[string]any{"delays": []any{1, 10}, "ints": []any{1, 4, 7}, "initialFactor": 2500, "order": 1, "perDay": 20, "bury": false},
+			"rev":   map[string]any{"perDay": 200, "ease4": 1.3, "fuzz": 0.05, "maxIvl": 36500, "ivlFct": 1, "bury": false, "hardFactor": 1.2},
+			"lapse": map[string]any{"delays": []any{10}, "mult": 0, "minInt": 1, "leechFails": 8, "leechAction": 1},
+		},
+	}
+
+	conf := map[string]any{
+		"nextPos": len(deck.Cards) + 1, "estTimes": true, "activeDecks": []any{1}, "sortType": "noteFld",
+		"timeLim": 0, "sortBackwards": false, "addToCur": true, "curDeck": 1, "newSpread": 0,
+		"dueCounts": true, "curModel": fmt.Sprint(modelId), "collapseTime": 1200,
+	}
+
+	encoded := []string{}
+	for _, value := range []any{conf, models, decks, dconf} {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding collection: %v", err)
+		}
+		encoded = append(encoded, string(data))
+	}
+
+	tmp, err := os.CreateTemp("", "sanctum-anki-*.db")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary collection: %v", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	db, err := sql.Open("sqlite", "file:"+tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("error creating collection: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error creating collection: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(ankiSchema); err != nil {
+		return nil, fmt.Errorf("error creating collection: %v", err)
+	}
+
+	_, err = tx.Exec("INSERT INTO col VALUES (1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}')",
+		now.Unix()/86400*86400, base, base, encoded[0], encoded[1], encoded[2], encoded[3])
+	if err != nil {
+		return nil, fmt.Errorf("error writing collection: %v", err)
+	}
+
+	for i, card := range deck.Cards {
+		id := base + 2 + int64(i)
+		front, back := ankiNoteFields(card)
+
+		// Anki tags are space-separated
+		tags := []string{}
+		for _, tag := range card.Tags {
+			tags = append(tags, strings.ReplaceAll(tag, " ", "_"))
+		}
+
+		guid := card.Uuid
+		if guid == "" {
+			guid = fmt.Sprint(id)
+		}
+
+		_, err = tx.Exec("INSERT INTO notes VALUES (?, ?, ?, ?, -1, ?, ?, ?, ?, 0, '')",
+			id, guid, modelId, now.Unix(), " "+strings.Join(tags, " ")+" ", front+"\x1f"+back, card.Pattern, ankiChecksum(front))
+		if err != nil {
+			return nil, fmt.Errorf("error writing note: %v", err)
+		}
+
+		_, err = tx.Exec("INSERT INTO cards VALUES (?, ?, ?, 0, ?, -1, 0, 0, ?, 0, 0, 0, 0, 0, 0, 0, 0, '')",
+			id, id, deckId, now.Unix(), i+1)
+		if err != nil {
+			return nil, fmt.Errorf("error writing card: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error writing collection: %v", err)
+	}
+	db.Close()
+
+	collection, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("error reading collection: %v", err)
+	}
+
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, file := range []ArchiveFile{
+		{Name: "collection.anki2", Data: collection},
+		{Name: "media", Data: []byte("{}")},
+	} {
+		entry, err := writer.Create(file.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error writing package: %v", err)
+		}
+		if _, err := entry.Write(file.Data); err != nil {
+			return nil, fmt.Errorf("error writing package: %v", err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("error writing package: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Uncompressed size limit for an uploaded archive, so a small zip can't
+// expand into something that exhausts memory
+const MAX_ARCHIVE_SIZE = 64 << 20
+
+const MAX_ARCHIVE_FILES = 2000
+
+type ArchiveFile struct {
+	Name string
+	Data []byte
+}
+
+// ReadArchive returns the files in a zip whose names end in one of
+// extensions, skipping directories and hidden files such as .obsidian/ and
+// macOS resource forks
+func ReadArchive(data []byte, extensions ...string) ([]ArchiveFile, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("error reading zip: %v", err)
+	}
+
+	files := []ArchiveFile{}
+	var total int64
+	for _, entry := range reader.File {
+		if entry.FileInfo().IsDir() || hiddenPath(entry.Name) || !hasExtension(entry.Name, extensions) {
+			continue
+		}
+
+		if len(files) == MAX_ARCHIVE_FILES {
+			return nil, fmt.Errorf("zip has more than %d files", MAX_ARCHIVE_FILES)
+		}
+
+		content, err := entry.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s from zip: %v", entry.Name, err)
+		}
+
+		// Read one byte past the limit to tell a file that fits exactly from
+		// one that doesn't, without trusting the sizes in the zip header
+		fileData, err := io.ReadAll(io.LimitReader(content, MAX_ARCHIVE_SIZE-total+1))
+		content.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s from zip: %v", entry.Name, err)
+		}
+
+		total += int64(len(fileData))
+		if total > MAX_ARCHIVE_SIZE {
+			return nil, fmt.Errorf("zip expands to more than %d bytes", MAX_ARCHIVE_SIZE)
+		}
+
+		files = append(files, ArchiveFile{Name: entry.Name, Data: fileData})
+	}
+
+	return files, nil
+}
+
+func hiddenPath(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasExtension(name string, extensions []string) bool {
+	if len(extensions) == 0 {
+		return true
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	for _, extension := range extensions {
+		if ext == extension {
+			return true
+		}
+	}
+	return false
+}
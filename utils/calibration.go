@@ -0,0 +1,294 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+const CALIBRATION_DEFAULT_PATH = "calibration.json"
+
+// A scope needs this many labelled grades, with at least one pass and one
+// fail, before thresholds are learned for it
+const CALIBRATION_MIN_SAMPLES = 10
+
+// Only the most recent samples per scope are kept, so calibration follows
+// changes in how cards are written and graded
+const CALIBRATION_MAX_SAMPLES = 500
+
+// The calibrated score a raw grade exactly at the pass threshold maps to
+const CALIBRATED_PASS_SCORE = 60
+
+const DEFAULT_SCOPE = "default"
+
+// Calibration maps a raw cosine grade onto a 0-100 score that's piecewise
+// linear through Low -> 0, PassThreshold -> CALIBRATED_PASS_SCORE and
+// High -> 100. Manual calibrations were set explicitly and are never
+// overwritten by learning.
+type Calibration struct {
+	Low           float32 `json:"low"`
+	PassThreshold float32 `json:"passThreshold"`
+	High          float32 `json:"high"`
+	Samples       int     `json:"samples"`
+	Manual        bool    `json:"manual"`
+}
+
+// Raw cosine grades for real embeddings mostly land between 70 and 95
+var DefaultCalibration = Calibration{
+	Low:           70,
+	PassThreshold: 85,
+	High:          95,
+}
+
+type LabelledGrade struct {
+	Uuid     string  `json:"uuid"`
+	Deck     string  `json:"deck,omitempty"`
+	RawGrade float32 `json:"rawGrade"`
+	Passed   bool    `json:"passed"`
+}
+
+func CardScope(cardId string) string {
+	return "card:" + cardId
+}
+
+func DeckScope(deck string) string {
+	return "deck:" + deck
+}
+
+func (c Calibration) Valid() bool {
+	return c.Low < c.PassThreshold && c.PassThreshold < c.High
+}
+
+// Apply returns the calibrated score and whether raw is a pass
+func (c Calibration) Apply(raw float32) (float32, bool) {
+	var score float32
+	if raw < c.PassThreshold {
+		score = CALIBRATED_PASS_SCORE * (raw - c.Low) / (c.PassThreshold - c.Low)
+	} else {
+		score = CALIBRATED_PASS_SCORE + (100-CALIBRATED_PASS_SCORE)*(raw-c.PassThreshold)/(c.High-c.PassThreshold)
+	}
+
+	return max(0, min(100, score)), raw >= c.PassThreshold
+}
+
+// CalibrationStore holds per-card, per-deck and default calibrations along
+// with the labelled grades they were learned from, persisted to a JSON file
+type CalibrationStore struct {
+	path         string
+	mu           sync.Mutex
+	Calibrations map[string]*Calibration    `json:"calibrations"`
+	Samples      map[string][]LabelledGrade `json:"samples"`
+}
+
+var (
+	calibrationInstance *CalibrationStore
+	calibrationOnce     sync.Once
+	calibrationErr      error
+)
+
+func GetCalibrationStore() (*CalibrationStore, error) {
+	calibrationOnce.Do(func() {
+		path := os.Getenv("SANCTUM_CALIBRATION_PATH")
+		if path == "" {
+			path = CALIBRATION_DEFAULT_PATH
+		}
+
+		calibrationInstance, calibrationErr = OpenCalibrationStore(path)
+	})
+
+	return calibrationInstance, calibrationErr
+}
+
+func OpenCalibrationStore(path string) (*CalibrationStore, error) {
+	cs := &CalibrationStore{
+		path:         path,
+		Calibrations: map[string]*Calibration{},
+		Samples:      map[string][]LabelledGrade{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading calibration: %v", err)
+	}
+
+	if err := json.Unmarshal(data, cs); err != nil {
+		return nil, fmt.Errorf("error parsing calibration: %v", err)
+	}
+
+	return cs, nil
+}
+
+// save writes the store to disk; callers must hold cs.mu
+func (cs *CalibrationStore) save() error {
+	data, err := json.Marshal(cs)
+	if err != nil {
+		return fmt.Errorf("error encoding calibration: %v", err)
+	}
+
+	if err := writeFileAtomic(cs.path, data); err != nil {
+		return fmt.Errorf("error writing calibration: %v", err)
+	}
+
+	return nil
+}
+
+// Lookup returns the most specific calibration for a card: its own, then its
+// deck's, then the default scope, then DefaultCalibration
+func (cs *CalibrationStore) Lookup(cardId string, deck string) (Calibration, string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	scopes := []string{CardScope(cardId)}
+	if deck != "" {
+		scopes = append(scopes, DeckScope(deck))
+	}
+	scopes = append(scopes, DEFAULT_SCOPE)
+
+	for _, scope := range scopes {
+		if c, ok := cs.Calibrations[scope]; ok {
+			return *c, scope
+		}
+	}
+
+	return DefaultCalibration, ""
+}
+
+// Set stores an explicit calibration for scope
+func (cs *CalibrationStore) Set(scope string, c Calibration) error {
+	if !c.Valid() {
+		return fmt.Errorf("calibration thresholds must satisfy low < passThreshold < high")
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c.Manual = true
+	c.Samples = len(cs.Samples[scope])
+	cs.Calibrations[scope] = &c
+
+	return cs.save()
+}
+
+// Record adds labelled grades to their card, deck and default scopes and
+// re-learns every affected scope that isn't manually calibrated. It returns
+// the calibrations that changed.
+func (cs *CalibrationStore) Record(labels []LabelledGrade) (map[string]Calibration, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	touched := map[string]bool{}
+	for _, label := range labels {
+		scopes := []string{CardScope(label.Uuid), DEFAULT_SCOPE}
+		if label.Deck != "" {
+			scopes = append(scopes, DeckScope(label.Deck))
+		}
+
+		for _, scope := range scopes {
+			samples := append(cs.Samples[scope], label)
+			if len(samples) > CALIBRATION_MAX_SAMPLES {
+				samples = samples[len(samples)-CALIBRATION_MAX_SAMPLES:]
+			}
+			cs.Samples[scope] = samples
+			touched[scope] = true
+		}
+	}
+
+	updated := map[string]Calibration{}
+	for scope := range touched {
+		if existing, ok := cs.Calibrations[scope]; ok && existing.Manual {
+			continue
+		}
+
+		c, ok := fitCalibration(cs.Samples[scope])
+		if !ok {
+			continue
+		}
+
+		cs.Calibrations[scope] = &c
+		updated[scope] = c
+	}
+
+	if err := cs.save(); err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+// fitCalibration picks the pass threshold that best separates passes from
+// fails, and anchors Low and High at the 10th percentile of fails and the
+// 90th percentile of passes
+func fitCalibration(samples []LabelledGrade) (Calibration, bool) {
+	var passes, fails []float32
+	for _, sample := range samples {
+		if sample.Passed {
+			passes = append(passes, sample.RawGrade)
+		} else {
+			fails = append(fails, sample.RawGrade)
+		}
+	}
+
+	if len(samples) < CALIBRATION_MIN_SAMPLES || len(passes) == 0 || len(fails) == 0 {
+		return Calibration{}, false
+	}
+
+	sorted := make([]LabelledGrade, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].RawGrade < sorted[j].RawGrade })
+
+	// With the threshold just above sorted[i], everything up to i is a
+	// predicted fail. Start with every sample predicted as a pass.
+	correct := len(passes)
+	bestCorrect := correct
+	threshold := sorted[0].RawGrade
+	for i, sample := range sorted {
+		if sample.Passed {
+			correct -= 1
+		} else {
+			correct += 1
+		}
+
+		if i+1 < len(sorted) && sorted[i+1].RawGrade == sample.RawGrade {
+			continue
+		}
+
+		if correct > bestCorrect {
+			bestCorrect = correct
+			if i+1 < len(sorted) {
+				threshold = (sample.RawGrade + sorted[i+1].RawGrade) / 2
+			} else {
+				threshold = sample.RawGrade + 1
+			}
+		}
+	}
+
+	c := Calibration{
+		Low:           percentile(fails, 0.1),
+		PassThreshold: threshold,
+		High:          percentile(passes, 0.9),
+		Samples:       len(samples),
+	}
+
+	if c.Low >= c.PassThreshold {
+		c.Low = c.PassThreshold - 1
+	}
+	if c.High <= c.PassThreshold {
+		c.High = c.PassThreshold + 1
+	}
+
+	return c, true
+}
+
+func percentile(values []float32, p float64) float32 {
+	sorted := make([]float32, len(values))
+	copy(sorted, values)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[int(p*float64(len(sorted)-1))]
+}
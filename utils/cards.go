@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A card can have at most this many accepted answers, including Match, so
+// that all of its answer vectors can be fetched by ID in one call
+const MAX_ACCEPTED_ANSWERS = 10
+
+// Tags are stored in vector metadata, which Pinecone caps per vector, so a
+// card keeps at most this many
+const MAX_TAGS = 10
+
+// Every vector of a card carries its text and notes in its metadata, which
+// Pinecone caps at 40KB per vector, so cards are limited to these lengths in
+// bytes. The question, each answer and option, and a cloze note's text each
+// get MAX_CARD_TEXT_LENGTH, and all of them together MAX_CARD_TOTAL_LENGTH.
+const (
+	MAX_CARD_TEXT_LENGTH  = 2000
+	MAX_NOTES_LENGTH      = 4000
+	MAX_CARD_TOTAL_LENGTH = 24000
+)
+
+type Difficulty string
+
+const (
+	DifficultyEasy   Difficulty = "easy"
+	DifficultyMedium Difficulty = "medium"
+	DifficultyHard   Difficulty = "hard"
+)
+
+// Where a card came from, when the client doesn't say
+const (
+	SOURCE_MANUAL    = "manual"
+	SOURCE_GENERATED = "generated"
+	SOURCE_DOCUMENT  = "document"
+	SOURCE_MARKDOWN  = "markdown"
+	SOURCE_ANKI      = "anki"
+	SOURCE_IMPORT    = "import"
+)
+
+func (difficulty Difficulty) Valid() bool {
+	switch difficulty {
+	case "", DifficultyEasy, DifficultyMedium, DifficultyHard:
+		return true
+	}
+	return false
+}
+
+// NormalizeTags lowercases and trims tags, dropping empty and repeated ones,
+// so filtering on "Biology" finds cards tagged "biology "
+func NormalizeTags(tags []string) []string {
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		key := strings.ToLower(strings.TrimSpace(tag))
+		if key == "" || seen[key] {
+			continue
+		}
+		if len(normalized) == MAX_TAGS {
+			break
+		}
+
+		seen[key] = true
+		normalized = append(normalized, key)
+	}
+
+	return normalized
+}
+
+// Stamp fills in the metadata a card must have before it's stored: a
+// creation time, a source and normalized tags
+func (card Flashcard) Stamp(source string) Flashcard {
+	if card.Created == 0 {
+		card.Created = time.Now().Unix()
+	}
+	if card.Source == "" {
+		card.Source = source
+	}
+	card.Tags = NormalizeTags(card.Tags)
+
+	return card
+}
+
+// Validate checks that the card's text fits in its vectors' metadata
+func (card Flashcard) Validate() error {
+	fields := []struct {
+		name  string
+		texts []string
+	}{
+		{"pattern", []string{card.Pattern}},
+		{"match", []string{card.Match}},
+		{"text", []string{card.Text}},
+		{"accepted answer", card.Accepted},
+		{"option", card.Options},
+		{"distractor", card.Distractors},
+	}
+
+	total := len(card.Notes)
+	for _, field := range fields {
+		for _, text := range field.texts {
+			if len(text) > MAX_CARD_TEXT_LENGTH {
+				return fmt.Errorf("%s is %d bytes long, at most %d are allowed", field.name, len(text), MAX_CARD_TEXT_LENGTH)
+			}
+			total += len(text)
+		}
+	}
+
+	if len(card.Notes) > MAX_NOTES_LENGTH {
+		return fmt.Errorf("notes are %d bytes long, at most %d are allowed", len(card.Notes), MAX_NOTES_LENGTH)
+	}
+	if total > MAX_CARD_TOTAL_LENGTH {
+		return fmt.Errorf("card text is %d bytes long in all, at most %d are allowed", total, MAX_CARD_TOTAL_LENGTH)
+	}
+
+	return nil
+}
+
+// Answers returns Match followed by the distinct, non-empty accepted
+// alternatives, capped at MAX_ACCEPTED_ANSWERS
+func (card Flashcard) Answers() []string {
+	answers := []string{card.Match}
+	seen := map[string]bool{strings.ToLower(strings.TrimSpace(card.Match)): true}
+
+	for _, answer := range card.Accepted {
+		key := strings.ToLower(strings.TrimSpace(answer))
+		if key == "" || seen[key] {
+			continue
+		}
+		if len(answers) == MAX_ACCEPTED_ANSWERS {
+			break
+		}
+
+		seen[key] = true
+		answers = append(answers, answer)
+	}
+
+	return answers
+}
+
+// AnswerVectorId is the Pinecone ID of a card's index-th accepted answer. The
+// primary answer uses the card's own UUID so older cards keep working.
+func AnswerVectorId(cardId string, index int) string {
+	if index == 0 {
+		return cardId
+	}
+	return fmt.Sprintf("%s#%d", cardId, index)
+}
+
+// PatternVectorId is the Pinecone ID of the vector embedding a card's
+// question, which is only used for search
+func PatternVectorId(cardId string) string {
+	return cardId + "#pattern"
+}
+
+func AnswerVectorIds(cardId string) []string {
+	ids := []string{}
+	for i := 0; i < MAX_ACCEPTED_ANSWERS; i += 1 {
+		ids = append(ids, AnswerVectorId(cardId, i))
+	}
+	return ids
+}
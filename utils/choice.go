@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+const CardMultipleChoice CardType = "multiple_choice"
+
+// Distractors whose cosine grade against any accepted answer is at or above
+// this are too close to the answer to be fair, e.g. "USSR" vs "Soviet Union"
+const DISTRACTOR_MAX_SIMILARITY = 92
+
+const MIN_DISTRACTORS = 2
+const MAX_DISTRACTORS = 4
+
+func normalizeChoice(text string) string {
+	return strings.ToLower(strings.TrimSpace(text))
+}
+
+// PrepareMultipleChoice filters the card's distractors and fills in Options,
+// the shuffled list of choices shown to the student. Distractors are taken
+// from Distractors, or failing that from any Options that aren't answers.
+func PrepareMultipleChoice(card Flashcard) (Flashcard, error) {
+	answers := card.Answers()
+
+	isAnswer := map[string]bool{}
+	for _, answer := range answers {
+		isAnswer[normalizeChoice(answer)] = true
+	}
+
+	candidates := card.Distractors
+	if len(candidates) == 0 {
+		candidates = card.Options
+	}
+
+	distractors := []string{}
+	seen := map[string]bool{}
+	for _, distractor := range candidates {
+		key := normalizeChoice(distractor)
+		if key == "" || isAnswer[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		distractors = append(distractors, strings.TrimSpace(distractor))
+	}
+
+	embeddings, err := GetEmbedCache().Embed(append(append([]string{}, answers...), distractors...))
+	if err != nil {
+		return card, fmt.Errorf("unable to embed choices: %v", err)
+	}
+
+	kept := []string{}
+	for i, distractor := range distractors {
+		distractorEmbed := &embeddings[len(answers)+i]
+
+		tooClose := false
+		for j := range answers {
+			if CosineSimilarity(&embeddings[j], distractorEmbed) >= DISTRACTOR_MAX_SIMILARITY {
+				tooClose = true
+				break
+			}
+		}
+
+		if !tooClose && len(kept) < MAX_DISTRACTORS {
+			kept = append(kept, distractor)
+		}
+	}
+
+	if len(kept) < MIN_DISTRACTORS {
+		return card, fmt.Errorf("only %d of %d distractors are distinct enough from the answer", len(kept), len(distractors))
+	}
+
+	options := append([]string{card.Match}, kept...)
+	rand.Shuffle(len(options), func(i, j int) { options[i], options[j] = options[j], options[i] })
+
+	card.Type = CardMultipleChoice
+	card.Distractors = kept
+	card.Options = options
+
+	return card, nil
+}
+
+// GradeChoice scores a selected option exactly: full marks for the answer
+// (or an accepted alternative), nothing for anything else
+func GradeChoice(card Flashcard, selected string) GradeResult {
+	correct := false
+	for _, answer := range card.Answers() {
+		if normalizeChoice(answer) == normalizeChoice(selected) {
+			correct = true
+			break
+		}
+	}
+
+	result := GradeResult{
+		Mode:          GradeExact,
+		Verdict:       VerdictIncorrect,
+		MatchedAnswer: card.Match,
+		Passed:        &correct,
+	}
+
+	if correct {
+		result.NumericGrade = 100
+		result.Verdict = VerdictCorrect
+	}
+
+	return result
+}
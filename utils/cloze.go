@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type CardType string
+
+const (
+	CardBasic CardType = "basic"
+	CardCloze CardType = "cloze"
+)
+
+// Matches {{c1::answer}} and {{c1::answer::hint}}
+var clozePattern = regexp.MustCompile(`\{\{c(\d+)::(.*?)(?:::(.*?))?\}\}`)
+
+type ClozeDeletion struct {
+	Index  int
+	Answer string
+	Hint   string
+}
+
+func (cardType CardType) Valid() bool {
+	switch cardType {
+	case "", CardBasic, CardCloze, CardMultipleChoice:
+		return true
+	}
+	return false
+}
+
+// ParseCloze returns the deletions in text, grouped by cloze index
+func ParseCloze(text string) (map[int][]ClozeDeletion, error) {
+	deletions := map[int][]ClozeDeletion{}
+	for _, match := range clozePattern.FindAllStringSubmatch(text, -1) {
+		index, err := strconv.Atoi(match[1])
+		if err != nil || index < 1 {
+			return nil, fmt.Errorf("invalid cloze index c%s", match[1])
+		}
+
+		answer := strings.TrimSpace(match[2])
+		if answer == "" {
+			return nil, fmt.Errorf("cloze c%d has an empty answer", index)
+		}
+
+		deletions[index] = append(deletions[index], ClozeDeletion{
+			Index:  index,
+			Answer: answer,
+			Hint:   strings.TrimSpace(match[3]),
+		})
+	}
+
+	if len(deletions) == 0 {
+		return nil, fmt.Errorf("cloze text has no {{c1::...}} deletions")
+	}
+
+	return deletions, nil
+}
+
+// RenderCloze blanks out the deletions for index and reveals all the others
+func RenderCloze(text string, index int) string {
+	return clozePattern.ReplaceAllStringFunc(text, func(marker string) string {
+		match := clozePattern.FindStringSubmatch(marker)
+		if n, _ := strconv.Atoi(match[1]); n != index {
+			return match[2]
+		}
+
+		if hint := strings.TrimSpace(match[3]); hint != "" {
+			return "[" + hint + "]"
+		}
+		return "[...]"
+	})
+}
+
+// ExpandCloze turns a cloze note into one card per cloze index. Each sub-card
+// is an ordinary pattern/match card with its own UUID, so it's embedded and
+// graded against just its own blank; Parent links it back to the note.
+func ExpandCloze(note Flashcard) ([]Flashcard, error) {
+	deletions, err := ParseCloze(note.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := []int{}
+	for index := range deletions {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+
+	parent := note.Uuid
+	if parent == "" {
+		parent = uuid.New().String()
+	}
+
+	cards := []Flashcard{}
+	for _, index := range indices {
+		answers := []string{}
+		for _, deletion := range deletions[index] {
+			answers = append(answers, deletion.Answer)
+		}
+
+		cards = append(cards, Flashcard{
+			Type:    CardCloze,
+			Text:    note.Text,
+			Cloze:   index,
+			Parent:  parent,
+			Pattern: RenderCloze(note.Text, index),
+			Match:   strings.Join(answers, ", "),
+			Uuid:    uuid.New().String(),
+			Deck:    note.Deck,
+			Owner:   note.Owner,
+
+			Tags:       note.Tags,
+			Difficulty: note.Difficulty,
+			Source:     note.Source,
+			Notes:      note.Notes,
+			Created:    note.Created,
+			Document:   note.Document,
+			Chunk:      note.Chunk,
+			Templates:  note.Templates,
+			Subtopic:   note.Subtopic,
+		})
+	}
+
+	return cards, nil
+}
@@ -0,0 +1,365 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Fewer indexed cards than this can't say much about a deck's coverage
+const MIN_COVERAGE_CARDS = 5
+
+const MAX_COVERAGE_CLUSTERS = 12
+
+const KMEANS_ITERATIONS = 25
+
+// How many of a cluster's questions are shown to the model to label it
+const CLUSTER_SAMPLE_SIZE = 5
+
+// Cards less similar than this to every subtopic in the outline, on
+// CosineSimilarity's 0-100 scale, are counted as off the outline rather than
+// forced into the nearest subtopic
+const MIN_SUBTOPIC_SIMILARITY = 60
+
+// A subtopic with more than OVER_REPRESENTED_RATIO times its share of the
+// deck is over-represented; one with less than UNDER_REPRESENTED_RATIO times
+// its share is under-represented
+const (
+	OVER_REPRESENTED_RATIO  = 1.5
+	UNDER_REPRESENTED_RATIO = 0.5
+)
+
+type CoverageStatus string
+
+const (
+	CoverageCovered CoverageStatus = "covered"
+	CoverageOver    CoverageStatus = "over"
+	CoverageUnder   CoverageStatus = "under"
+	CoverageMissing CoverageStatus = "missing"
+)
+
+// CardCluster is a group of a deck's cards whose questions embed close
+// together. Subtopic is the outline subtopic most of its cards fall under.
+type CardCluster struct {
+	Label    string   `json:"label"`
+	Subtopic string   `json:"subtopic,omitempty"`
+	Size     int      `json:"size"`
+	Cards    []string `json:"cards"`
+	Samples  []string `json:"samples"`
+}
+
+// SubtopicCoverage compares how many of a deck's cards fall under an outline
+// subtopic (Actual) with its share of the deck (Cards). Missing is how many
+// cards it would take to bring an under-represented subtopic up to its share.
+type SubtopicCoverage struct {
+	Subtopic
+	Actual  int            `json:"actual"`
+	Status  CoverageStatus `json:"status"`
+	Missing int            `json:"missing"`
+}
+
+type DeckCoverage struct {
+	Deck       string             `json:"deck"`
+	Title      string             `json:"title"`
+	Cards      int                `json:"cards"`
+	Unindexed  int                `json:"unindexed"`
+	OffOutline int                `json:"offOutline"`
+	Clusters   []CardCluster      `json:"clusters"`
+	Subtopics  []SubtopicCoverage `json:"subtopics"`
+}
+
+// Gaps are the subtopics that need more cards
+func (coverage DeckCoverage) Gaps() []SubtopicCoverage {
+	gaps := []SubtopicCoverage{}
+	for _, subtopic := range coverage.Subtopics {
+		if subtopic.Missing > 0 {
+			gaps = append(gaps, subtopic)
+		}
+	}
+	return gaps
+}
+
+func unitVector(vector []float32) []float32 {
+	var norm float64
+	for _, value := range vector {
+		norm += float64(value) * float64(value)
+	}
+
+	unit := make([]float32, len(vector))
+	if norm == 0 {
+		return unit
+	}
+
+	scale := float32(1 / math.Sqrt(norm))
+	for i, value := range vector {
+		unit[i] = value * scale
+	}
+	return unit
+}
+
+// ClusterCount picks how many clusters to split n cards into, the usual
+// square root of n/2 rule of thumb
+func ClusterCount(n int) int {
+	return max(1, min(MAX_COVERAGE_CLUSTERS, int(math.Round(math.Sqrt(float64(n)/2)))))
+}
+
+// ClusterEmbeddings assigns each vector to one of k clusters by spherical
+// k-means, returning each vector's cluster. The first centroid is the first
+// vector and each next one the vector least like those already chosen, so
+// the same deck always clusters the same way.
+func ClusterEmbeddings(vectors [][]float32, k int) []int {
+	assignments := make([]int, len(vectors))
+	if len(vectors) == 0 {
+		return assignments
+	}
+	k = max(1, min(k, len(vectors)))
+
+	units := make([][]float32, len(vectors))
+	for i, vector := range vectors {
+		units[i] = unitVector(vector)
+	}
+
+	centroids := [][]float32{units[0]}
+	closest := make([]float32, len(units))
+	for i := range units {
+		closest[i] = DotProduct(&units[i], &centroids[0])
+	}
+	for len(centroids) < k {
+		farthest := 0
+		for i := range units {
+			if closest[i] < closest[farthest] {
+				farthest = i
+			}
+		}
+
+		centroids = append(centroids, units[farthest])
+		for i := range units {
+			closest[i] = max(closest[i], DotProduct(&units[i], &units[farthest]))
+		}
+	}
+
+	for iteration := 0; iteration < KMEANS_ITERATIONS; iteration += 1 {
+		changed := iteration == 0
+		for i := range units {
+			best := 0
+			bestSimilarity := float32(math.Inf(-1))
+			for j := range centroids {
+				if similarity := DotProduct(&units[i], &centroids[j]); similarity > bestSimilarity {
+					best, bestSimilarity = j, similarity
+				}
+			}
+
+			if assignments[i] != best {
+				assignments[i] = best
+				changed = true
+			}
+		}
+
+		if !changed {
+			break
+		}
+
+		sums := make([][]float32, k)
+		for i, cluster := range assignments {
+			if sums[cluster] == nil {
+				sums[cluster] = make([]float32, len(units[i]))
+			}
+			for d, value := range units[i] {
+				sums[cluster][d] += value
+			}
+		}
+
+		// A cluster that lost all its vectors keeps its old centroid
+		for j := range centroids {
+			if sums[j] != nil {
+				centroids[j] = unitVector(sums[j])
+			}
+		}
+	}
+
+	return assignments
+}
+
+// ClusterCards groups the cards that have embeddings into clusters, largest
+// first, each with up to CLUSTER_SAMPLE_SIZE of its questions as samples
+func ClusterCards(cards []Flashcard, embeddings map[string][]float32) []CardCluster {
+	indexed := []Flashcard{}
+	vectors := [][]float32{}
+	for _, card := range cards {
+		if embedding, ok := embeddings[card.Uuid]; ok {
+			indexed = append(indexed, card)
+			vectors = append(vectors, embedding)
+		}
+	}
+
+	k := ClusterCount(len(indexed))
+	assignments := ClusterEmbeddings(vectors, k)
+
+	clusters := make([]CardCluster, k)
+	for i, card := range indexed {
+		cluster := &clusters[assignments[i]]
+		cluster.Cards = append(cluster.Cards, card.Uuid)
+		cluster.Size += 1
+		if len(cluster.Samples) < CLUSTER_SAMPLE_SIZE {
+			cluster.Samples = append(cluster.Samples, card.Pattern)
+		}
+	}
+
+	nonEmpty := []CardCluster{}
+	for _, cluster := range clusters {
+		if cluster.Size > 0 {
+			nonEmpty = append(nonEmpty, cluster)
+		}
+	}
+
+	sort.SliceStable(nonEmpty, func(i, j int) bool {
+		return nonEmpty[i].Size > nonEmpty[j].Size
+	})
+
+	return nonEmpty
+}
+
+func GetClusterLabelsSchema() *ResponseFormat {
+	return &ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: JSONSchemaSpec{
+			Name: "cluster_labels",
+			Schema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"labels": map[string]any{
+						"type": "array",
+						"items": map[string]any{
+							"type": "object",
+							"properties": map[string]any{
+								"group": map[string]any{"type": "integer"},
+								"label": map[string]any{"type": "string"},
+							},
+							"required":             []string{"group", "label"},
+							"additionalProperties": false,
+						},
+					},
+				},
+				"required":             []string{"labels"},
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+// LabelClusters asks the chat model, with messages listing the clusters as
+// numbered groups counting from 0, for a label for each cluster. Clusters the
+// model skips are labelled with their first sample question.
+func LabelClusters(messages []Message, clusters []CardCluster) error {
+	response, err := MakeOpenAIChatRequest(messages, GetClusterLabelsSchema())
+	if err != nil {
+		return err
+	}
+
+	var parsed struct {
+		Labels []struct {
+			Group int    `json:"group"`
+			Label string `json:"label"`
+		} `json:"labels"`
+	}
+	if err := json.Unmarshal([]byte(response), &parsed); err != nil {
+		return fmt.Errorf("error parsing cluster labels: %v", err)
+	}
+
+	for _, label := range parsed.Labels {
+		if label.Group >= 0 && label.Group < len(clusters) {
+			clusters[label.Group].Label = strings.TrimSpace(label.Label)
+		}
+	}
+
+	for i := range clusters {
+		if clusters[i].Label == "" && len(clusters[i].Samples) > 0 {
+			clusters[i].Label = clusters[i].Samples[0]
+		}
+	}
+
+	return nil
+}
+
+// CompareCoverage counts the cards under each outline subtopic, matching
+// each card's embedding to the nearest subtopic's, and sets each cluster's
+// Subtopic to the one most of its cards fall under. It returns the coverage
+// of each subtopic and how many cards fell under none of them.
+func CompareCoverage(outline []Subtopic, clusters []CardCluster, embeddings map[string][]float32) ([]SubtopicCoverage, int, error) {
+	texts := []string{}
+	for _, subtopic := range outline {
+		text := subtopic.Title
+		if subtopic.Description != "" {
+			text += ": " + subtopic.Description
+		}
+		texts = append(texts, text)
+	}
+
+	subtopicEmbeddings, err := GetEmbedCache().Embed(texts)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error embedding outline: %v", err)
+	}
+
+	coverage := make([]SubtopicCoverage, len(outline))
+	for i, subtopic := range outline {
+		coverage[i] = SubtopicCoverage{Subtopic: subtopic}
+	}
+
+	offOutline := 0
+	for c := range clusters {
+		counts := make([]int, len(outline))
+		for _, cardId := range clusters[c].Cards {
+			embedding := embeddings[cardId]
+
+			best := -1
+			bestSimilarity := float32(MIN_SUBTOPIC_SIMILARITY)
+			for i := range subtopicEmbeddings {
+				if similarity := CosineSimilarity(&embedding, &subtopicEmbeddings[i]); similarity >= bestSimilarity {
+					best, bestSimilarity = i, similarity
+				}
+			}
+
+			if best < 0 {
+				offOutline += 1
+				continue
+			}
+			coverage[best].Actual += 1
+			counts[best] += 1
+		}
+
+		majority := -1
+		for i, count := range counts {
+			if count > 0 && (majority < 0 || count > counts[majority]) {
+				majority = i
+			}
+		}
+		if majority >= 0 {
+			clusters[c].Subtopic = outline[majority].Title
+		}
+	}
+
+	for i := range coverage {
+		expected := float64(coverage[i].Cards)
+		actual := float64(coverage[i].Actual)
+
+		switch {
+		case coverage[i].Actual == 0:
+			coverage[i].Status = CoverageMissing
+		case actual < expected*UNDER_REPRESENTED_RATIO:
+			coverage[i].Status = CoverageUnder
+		case actual > expected*OVER_REPRESENTED_RATIO:
+			coverage[i].Status = CoverageOver
+		default:
+			coverage[i].Status = CoverageCovered
+		}
+
+		// A subtopic whose share rounded down to nothing still needs a card
+		if coverage[i].Status == CoverageMissing || coverage[i].Status == CoverageUnder {
+			coverage[i].Missing = max(1, coverage[i].Cards-coverage[i].Actual)
+		}
+	}
+
+	return coverage, offOutline, nil
+}
@@ -0,0 +1,272 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const DECK_STORE_DEFAULT_DIR = "decks"
+
+// Decks used to all be kept in this one file; it's split into the deck
+// directory the first time the store is opened
+const DECK_STORE_LEGACY_PATH = "decks.json"
+
+var ErrDeckNotFound = errors.New("deck not found")
+var ErrDeckNotOwned = errors.New("deck belongs to another user")
+
+// DeckStore keeps every deck's cards, as saved, with each deck persisted to
+// its own JSON file so saving a card only rewrites its deck. Pinecone can
+// only look cards up by vector or ID, so this is what exports and other
+// whole-deck operations read from.
+//
+// Decks only get here as cards are saved, so decks made before the store
+// existed aren't in it and can't be exported or analysed. Their cards are
+// still indexed, and can be found with /search.
+type DeckStore struct {
+	dir   string
+	mu    sync.Mutex
+	decks map[string]*FlashcardDeck
+
+	// Which deck each card is in, so removing one doesn't scan every deck
+	cardDecks map[string]string
+}
+
+var (
+	deckStoreInstance *DeckStore
+	deckStoreOnce     sync.Once
+	deckStoreErr      error
+)
+
+func GetDeckStore() (*DeckStore, error) {
+	deckStoreOnce.Do(func() {
+		dir := os.Getenv("SANCTUM_DECK_DIR")
+		if dir == "" {
+			dir = DECK_STORE_DEFAULT_DIR
+		}
+
+		deckStoreInstance, deckStoreErr = OpenDeckStore(dir)
+		if deckStoreErr == nil {
+			deckStoreErr = deckStoreInstance.importLegacy(DECK_STORE_LEGACY_PATH)
+		}
+	})
+
+	return deckStoreInstance, deckStoreErr
+}
+
+func OpenDeckStore(dir string) (*DeckStore, error) {
+	ds := &DeckStore{
+		dir:       dir,
+		decks:     map[string]*FlashcardDeck{},
+		cardDecks: map[string]string{},
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating deck directory: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing decks: %v", err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading deck %s: %v", file, err)
+		}
+
+		deck := &FlashcardDeck{}
+		if err := json.Unmarshal(data, deck); err != nil {
+			return nil, fmt.Errorf("error parsing deck %s: %v", file, err)
+		}
+
+		ds.decks[deck.Id] = deck
+		for _, card := range deck.Cards {
+			ds.cardDecks[card.Uuid] = deck.Id
+		}
+	}
+
+	return ds, nil
+}
+
+// importLegacy moves the decks in a single-file store at path into this one,
+// then renames the file so it isn't imported again
+func (ds *DeckStore) importLegacy(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading legacy decks: %v", err)
+	}
+
+	legacy := map[string]*FlashcardDeck{}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return fmt.Errorf("error parsing legacy decks: %v", err)
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	for id, deck := range legacy {
+		if _, ok := ds.decks[id]; ok {
+			continue
+		}
+
+		ds.decks[id] = deck
+		for _, card := range deck.Cards {
+			ds.cardDecks[card.Uuid] = id
+		}
+		if err := ds.saveDeck(deck); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(path, path+".imported")
+}
+
+// deckFile is where a deck is saved. Deck IDs can come from clients, so
+// they're encoded rather than used as file names directly.
+func (ds *DeckStore) deckFile(deckId string) string {
+	return filepath.Join(ds.dir, base64.RawURLEncoding.EncodeToString([]byte(deckId))+".json")
+}
+
+// saveDeck writes one deck to disk; callers must hold ds.mu
+func (ds *DeckStore) saveDeck(deck *FlashcardDeck) error {
+	data, err := json.Marshal(deck)
+	if err != nil {
+		return fmt.Errorf("error encoding deck: %v", err)
+	}
+
+	if err := writeFileAtomic(ds.deckFile(deck.Id), data); err != nil {
+		return fmt.Errorf("error writing deck: %v", err)
+	}
+
+	return nil
+}
+
+// Add saves cards into their decks, creating any deck that doesn't exist
+// yet with the given title. A card that's already saved is replaced. Cards
+// without a deck aren't kept. If any card's deck belongs to someone other
+// than the card's owner, nothing is saved and ErrDeckNotOwned is returned.
+func (ds *DeckStore) Add(title string, cards []Flashcard) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	// Checked up front so a rejected batch doesn't leave half its cards saved
+	for _, card := range cards {
+		if deck, ok := ds.decks[card.Deck]; ok && deck.Owner != card.Owner {
+			return ErrDeckNotOwned
+		}
+	}
+
+	changed := map[string]*FlashcardDeck{}
+	for _, card := range cards {
+		if card.Deck == "" {
+			continue
+		}
+
+		deck, ok := ds.decks[card.Deck]
+		if !ok {
+			deck = &FlashcardDeck{
+				Id:    card.Deck,
+				Title: title,
+				Owner: card.Owner,
+				Cards: []Flashcard{},
+			}
+			ds.decks[card.Deck] = deck
+		}
+
+		replaced := false
+		for i := range deck.Cards {
+			if deck.Cards[i].Uuid == card.Uuid {
+				deck.Cards[i] = card
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			deck.Cards = append(deck.Cards, card)
+		}
+
+		ds.cardDecks[card.Uuid] = deck.Id
+		changed[deck.Id] = deck
+	}
+
+	for _, deck := range changed {
+		if err := ds.saveDeck(deck); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CanAdd reports whether owner can add cards to the deck, which is when it
+// doesn't exist yet or is theirs
+func (ds *DeckStore) CanAdd(deckId string, owner string) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	deck, ok := ds.decks[deckId]
+	return !ok || deck.Owner == owner
+}
+
+// Get returns a copy of owner's deck
+func (ds *DeckStore) Get(deckId string, owner string) (FlashcardDeck, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	// Other users' decks look the same as missing ones
+	deck, ok := ds.decks[deckId]
+	if !ok || deck.Owner != owner {
+		return FlashcardDeck{}, ErrDeckNotFound
+	}
+
+	copied := *deck
+	copied.Cards = append([]Flashcard{}, deck.Cards...)
+	copied.Outline = append([]Subtopic(nil), deck.Outline...)
+
+	return copied, nil
+}
+
+// SetOutline records the outline of owner's deck
+func (ds *DeckStore) SetOutline(deckId string, owner string, outline []Subtopic) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	deck, ok := ds.decks[deckId]
+	if !ok || deck.Owner != owner {
+		return ErrDeckNotFound
+	}
+
+	deck.Outline = append([]Subtopic(nil), outline...)
+
+	return ds.saveDeck(deck)
+}
+
+// Remove drops a card from whichever deck holds it
+func (ds *DeckStore) Remove(cardId string) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	deck, ok := ds.decks[ds.cardDecks[cardId]]
+	if !ok {
+		return nil
+	}
+	delete(ds.cardDecks, cardId)
+
+	for i, card := range deck.Cards {
+		if card.Uuid == cardId {
+			deck.Cards = append(deck.Cards[:i], deck.Cards[i+1:]...)
+			return ds.saveDeck(deck)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"fmt"
+	"html"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+type DocumentFormat string
+
+const (
+	DocumentText     DocumentFormat = "text"
+	DocumentMarkdown DocumentFormat = "markdown"
+	DocumentHTML     DocumentFormat = "html"
+)
+
+const MAX_DOCUMENT_SIZE = 2 << 20
+
+// Chunks are packed from whole paragraphs up to about this many bytes, which
+// keeps each generation request small enough to stay grounded in its text
+const DOCUMENT_CHUNK_SIZE = 3000
+
+// Each chunk is a separate generation request, so long documents are refused
+// rather than quietly running up a large bill
+const MAX_DOCUMENT_CHUNKS = 60
+
+var (
+	htmlHiddenPattern  = regexp.MustCompile(`(?is)<(?:script|style|noscript|head)\b[^>]*>.*?</(?:script|style|noscript|head)>`)
+	htmlHeadingPattern = regexp.MustCompile(`(?i)<h([1-6])\b[^>]*>`)
+	htmlBlockPattern   = regexp.MustCompile(`(?i)</?(?:p|div|br|h[1-6]|li|ul|ol|tr|table|section|article|blockquote|pre|hr)\b[^>]*>`)
+	htmlTagPattern     = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesPattern  = regexp.MustCompile(`\n{3,}`)
+)
+
+// DocumentChunk is one piece of an uploaded document. Index counts from 1;
+// Heading is the closest Markdown or HTML heading above the chunk, if any.
+type DocumentChunk struct {
+	Index   int    `json:"index"`
+	Heading string `json:"heading,omitempty"`
+	Text    string `json:"text,omitempty"`
+}
+
+// DetectDocumentFormat goes by file extension, then content type, and
+// otherwise treats the upload as plain text
+func DetectDocumentFormat(filename string, contentType string) DocumentFormat {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".md", ".markdown":
+		return DocumentMarkdown
+	case ".html", ".htm":
+		return DocumentHTML
+	case ".txt":
+		return DocumentText
+	}
+
+	switch {
+	case strings.HasPrefix(contentType, "text/markdown"):
+		return DocumentMarkdown
+	case strings.HasPrefix(contentType, "text/html"):
+		return DocumentHTML
+	}
+
+	return DocumentText
+}
+
+// ExtractDocumentText returns the document's readable text. Markdown is kept
+// as-is, since the model reads it fine and its headings are used for
+// chunking; HTML is reduced to text with headings turned into Markdown ones.
+func ExtractDocumentText(data []byte, format DocumentFormat) (string, error) {
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("document must be UTF-8 text")
+	}
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+
+	if format == DocumentHTML {
+		text = htmlHiddenPattern.ReplaceAllString(text, "")
+		text = htmlHeadingPattern.ReplaceAllStringFunc(text, func(tag string) string {
+			return "\n\n" + strings.Repeat("#", int(tag[2]-'0')) + " "
+		})
+		text = htmlBlockPattern.ReplaceAllString(text, "\n\n")
+		text = htmlTagPattern.ReplaceAllString(text, "")
+		text = html.UnescapeString(text)
+	}
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if format == DocumentHTML {
+			line = strings.Join(strings.Fields(line), " ")
+		}
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+
+	text = blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+
+	return strings.TrimSpace(text), nil
+}
+
+// ChunkDocument packs paragraphs into chunks of about DOCUMENT_CHUNK_SIZE,
+// starting a new chunk at each heading so a chunk stays on one section.
+// Paragraphs longer than a chunk are split between words.
+func ChunkDocument(text string) []DocumentChunk {
+	chunks := []DocumentChunk{}
+	heading := ""
+	current := strings.Builder{}
+
+	flush := func() {
+		if strings.TrimSpace(current.String()) == "" {
+			current.Reset()
+			return
+		}
+
+		chunks = append(chunks, DocumentChunk{
+			Index:   len(chunks) + 1,
+			Heading: heading,
+			Text:    strings.TrimSpace(current.String()),
+		})
+		current.Reset()
+	}
+
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+
+		if strings.HasPrefix(paragraph, "#") && !strings.Contains(paragraph, "\n") {
+			flush()
+			heading = strings.TrimSpace(strings.TrimLeft(paragraph, "#"))
+			current.WriteString(paragraph)
+			continue
+		}
+
+		for _, piece := range splitParagraph(paragraph) {
+			if current.Len() > 0 && current.Len()+len(piece)+2 > DOCUMENT_CHUNK_SIZE {
+				flush()
+			}
+
+			if current.Len() > 0 {
+				current.WriteString("\n\n")
+			}
+			current.WriteString(piece)
+		}
+	}
+
+	flush()
+
+	// A heading with nothing under it doesn't make a useful chunk
+	kept := []DocumentChunk{}
+	for _, chunk := range chunks {
+		if strings.HasPrefix(chunk.Text, "#") && !strings.Contains(chunk.Text, "\n") {
+			continue
+		}
+		chunk.Index = len(kept) + 1
+		kept = append(kept, chunk)
+	}
+
+	return kept
+}
+
+func splitParagraph(paragraph string) []string {
+	if len(paragraph) <= DOCUMENT_CHUNK_SIZE {
+		return []string{paragraph}
+	}
+
+	pieces := []string{}
+	current := strings.Builder{}
+	for _, word := range strings.Fields(paragraph) {
+		if current.Len() > 0 && current.Len()+len(word)+1 > DOCUMENT_CHUNK_SIZE {
+			pieces = append(pieces, current.String())
+			current.Reset()
+		}
+
+		if current.Len() > 0 {
+			current.WriteString(" ")
+		}
+		current.WriteString(word)
+	}
+
+	if current.Len() > 0 {
+		pieces = append(pieces, current.String())
+	}
+
+	return pieces
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const EMBED_MODEL = "text-embedding-3-small"
+
+const EMBED_CACHE_SIZE = 4096
+
+// OpenAI accepts at most 2048 inputs and 300k tokens per embedding request.
+// Batches stay well under both, counting tokens by estimateTokens since
+// long card text would hit the token limit well before the input one.
+const (
+	EMBED_BATCH_SIZE   = 1000
+	EMBED_BATCH_TOKENS = 100_000
+)
+
+// estimateTokens overestimates the tokens in text at about one per three
+// bytes; English averages closer to four
+func estimateTokens(text string) int {
+	return len(text)/3 + 1
+}
+
+// EmbedCache maps text to its embedding, keyed by a hash of the model and
+// text. The in-memory tier is a bounded LRU; if SANCTUM_EMBED_CACHE_DIR is
+// set, embeddings are also written there and survive restarts. The disk
+// tier isn't pruned, since an embedding only costs a few kilobytes.
+type EmbedCache struct {
+	memory *LRU[[]float32]
+	dir    string
+}
+
+var (
+	embedCacheInstance *EmbedCache
+	embedCacheOnce     sync.Once
+)
+
+func GetEmbedCache() *EmbedCache {
+	embedCacheOnce.Do(func() {
+		embedCacheInstance = &EmbedCache{
+			memory: NewLRU[[]float32](EMBED_CACHE_SIZE),
+			dir:    os.Getenv("SANCTUM_EMBED_CACHE_DIR"),
+		}
+	})
+
+	return embedCacheInstance
+}
+
+func (ec *EmbedCache) path(key string) string {
+	return filepath.Join(ec.dir, key[:2], key)
+}
+
+func (ec *EmbedCache) get(key string) ([]float32, bool) {
+	if embedding, ok := ec.memory.Get(key); ok {
+		return embedding, true
+	}
+
+	if ec.dir == "" {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(ec.path(key))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Error reading embedding cache:", err)
+		}
+		return nil, false
+	}
+
+	embedding := make([]float32, len(data)/4)
+	for i := range embedding {
+		embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+	}
+
+	ec.memory.Put(key, embedding)
+	return embedding, true
+}
+
+func (ec *EmbedCache) put(key string, embedding []float32) {
+	ec.memory.Put(key, embedding)
+
+	if ec.dir == "" {
+		return
+	}
+
+	data := make([]byte, len(embedding)*4)
+	for i, value := range embedding {
+		binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(value))
+	}
+
+	path := ec.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Println("Error writing embedding cache:", err)
+		return
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		log.Println("Error writing embedding cache:", err)
+	}
+}
+
+// Embed returns an embedding for each text, in order. Only texts missing
+// from the cache are sent to OpenAI, deduplicated, in as few requests as
+// EMBED_BATCH_SIZE and EMBED_BATCH_TOKENS allow.
+func (ec *EmbedCache) Embed(texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+
+	missing := []string{}
+	missingKeys := []string{}
+	positions := map[string][]int{}
+	for i, text := range texts {
+		key := HashKey(EMBED_MODEL, text)
+		if embedding, ok := ec.get(key); ok {
+			embeddings[i] = embedding
+			continue
+		}
+
+		if _, ok := positions[key]; !ok {
+			missing = append(missing, text)
+			missingKeys = append(missingKeys, key)
+		}
+		positions[key] = append(positions[key], i)
+	}
+
+	if len(missing) == 0 {
+		return embeddings, nil
+	}
+
+	for start, end := 0, 0; start < len(missing); start = end {
+		tokens := 0
+		for end = start; end < len(missing) && end-start < EMBED_BATCH_SIZE; end += 1 {
+			tokens += estimateTokens(missing[end])
+			if tokens > EMBED_BATCH_TOKENS && end > start {
+				break
+			}
+		}
+
+		data, err := MakeOpenAIEmbedRequest(missing[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		if len(*data) != end-start {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", end-start, len(*data))
+		}
+
+		for _, embedData := range *data {
+			if embedData.Index < 0 || embedData.Index >= end-start {
+				return nil, fmt.Errorf("embedding index %d out of range", embedData.Index)
+			}
+
+			key := missingKeys[start+embedData.Index]
+			ec.put(key, embedData.Embedding)
+
+			for _, position := range positions[key] {
+				embeddings[position] = embedData.Embedding
+			}
+		}
+	}
+
+	return embeddings, nil
+}
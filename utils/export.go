@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type ExportFormat string
+
+const (
+	ExportAnki     ExportFormat = "apkg"
+	ExportCSV      ExportFormat = "csv"
+	ExportTSV      ExportFormat = "tsv"
+	ExportJSON     ExportFormat = "json"
+	ExportMarkdown ExportFormat = "md"
+)
+
+// Columns of a CSV/TSV export. List columns are joined with LIST_SEPARATOR.
+var EXPORT_COLUMNS = []string{"uuid", "type", "pattern", "match", "accepted", "options", "tags", "difficulty", "notes"}
+
+const LIST_SEPARATOR = "; "
+
+var exportBlankLinesPattern = regexp.MustCompile(`\n\s*\n`)
+
+func (format ExportFormat) Valid() bool {
+	switch format {
+	case ExportAnki, ExportCSV, ExportTSV, ExportJSON, ExportMarkdown:
+		return true
+	}
+	return false
+}
+
+func (format ExportFormat) ContentType() string {
+	switch format {
+	case ExportAnki:
+		return "application/octet-stream"
+	case ExportCSV:
+		return "text/csv; charset=utf-8"
+	case ExportTSV:
+		return "text/tab-separated-values; charset=utf-8"
+	case ExportJSON:
+		return "application/json"
+	}
+	return "text/markdown; charset=utf-8"
+}
+
+// ExportDeck renders deck in format
+func ExportDeck(deck FlashcardDeck, format ExportFormat) ([]byte, error) {
+	switch format {
+	case ExportAnki:
+		return WriteAnkiPackage(deck)
+	case ExportCSV:
+		return exportDelimited(deck, ',')
+	case ExportTSV:
+		return exportDelimited(deck, '\t')
+	case ExportJSON:
+		return json.MarshalIndent(deck, "", "  ")
+	case ExportMarkdown:
+		return exportMarkdown(deck), nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// exportDelimited writes one row per card with a header row. encoding/csv
+// quotes any field containing the delimiter, a quote or a newline, which
+// spreadsheets read back correctly.
+func exportDelimited(deck FlashcardDeck, delimiter rune) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Comma = delimiter
+	writer.UseCRLF = true
+
+	if err := writer.Write(EXPORT_COLUMNS); err != nil {
+		return nil, fmt.Errorf("error writing export: %v", err)
+	}
+
+	for _, card := range deck.Cards {
+		row := []string{
+			card.Uuid,
+			string(card.Type),
+			card.Pattern,
+			card.Match,
+			strings.Join(card.Accepted, LIST_SEPARATOR),
+			strings.Join(card.Options, LIST_SEPARATOR),
+			strings.Join(card.Tags, LIST_SEPARATOR),
+			string(card.Difficulty),
+			card.Notes,
+		}
+
+		if err := writer.Write(row); err != nil {
+			return nil, fmt.Errorf("error writing export: %v", err)
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, fmt.Errorf("error writing export: %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// exportMarkdown writes a study sheet of Q:/A: blocks, which the Markdown
+// importer reads back. Multiple-choice options are listed under an Options:
+// line after the question.
+func exportMarkdown(deck FlashcardDeck) []byte {
+	// A blank line would end the block early
+	flatten := func(text string) string {
+		return exportBlankLinesPattern.ReplaceAllString(strings.TrimSpace(text), "\n")
+	}
+
+	var buf bytes.Buffer
+	title := deck.Title
+	if title == "" {
+		title = "Flashcards"
+	}
+	fmt.Fprintf(&buf, "# %s\n", flatten(title))
+
+	for _, card := range deck.Cards {
+		fmt.Fprintf(&buf, "\nQ: %s\n", flatten(card.Pattern))
+		if len(card.Options) > 0 {
+			// Each option has to stay on its own list line
+			buf.WriteString("Options:\n")
+			for _, option := range card.Options {
+				fmt.Fprintf(&buf, "- %s\n", strings.Join(strings.Fields(option), " "))
+			}
+		}
+
+		fmt.Fprintf(&buf, "A: %s\n", flatten(card.Match))
+		if len(card.Accepted) > 0 {
+			fmt.Fprintf(&buf, "Also accepted: %s\n", flatten(strings.Join(card.Accepted, LIST_SEPARATOR)))
+		}
+	}
+
+	return buf.Bytes()
+}
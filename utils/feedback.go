@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const FEEDBACK_CACHE_SIZE = 2048
+
+const feedbackPrompt = `You are a tutor reviewing a student's flashcard answer. You will be given the card's question, the reference answer and the student's answer.
+
+List the key points from the reference answer that the student left out, and anything in the student's answer that is wrong. Then explain the correct answer in one to three sentences, written to the student. Do not penalise wording or spelling. If the answer is fully correct, both lists should be empty.`
+
+// Feedback depends only on the card's text and the answer given, so it's
+// cached per (card, answer) pair
+var feedbackCache = NewLRU[GradeFeedback](FEEDBACK_CACHE_SIZE)
+
+func GetFeedbackSchema() *ResponseFormat {
+	return &ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: JSONSchemaSpec{
+			Name: "feedback",
+			Schema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"missing":     map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+					"incorrect":   map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+					"explanation": map[string]any{"type": "string"},
+				},
+				"required":             []string{"missing", "incorrect", "explanation"},
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+// GenerateFeedback explains what providedAnswer got wrong or left out
+// relative to the card's reference answer
+func GenerateFeedback(card Flashcard, providedAnswer string) (GradeFeedback, error) {
+	if card.Match == "" {
+		return GradeFeedback{}, fmt.Errorf("card %s has no stored answer text to compare against", card.Uuid)
+	}
+
+	key := HashKey(card.Uuid, strings.ToLower(strings.TrimSpace(providedAnswer)))
+	if feedback, ok := feedbackCache.Get(key); ok {
+		return feedback, nil
+	}
+
+	messages := []Message{
+		{
+			Role:    "system",
+			Content: feedbackPrompt,
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("Question: %s\nReference answer: %s\nStudent answer: %s", card.Pattern, strings.Join(card.Answers(), " / "), providedAnswer),
+		},
+	}
+
+	response, err := MakeOpenAIChatRequest(messages, GetFeedbackSchema())
+	if err != nil {
+		return GradeFeedback{}, fmt.Errorf("unable to generate feedback: %v", err)
+	}
+
+	var feedback GradeFeedback
+	if err := json.Unmarshal([]byte(response), &feedback); err != nil {
+		return GradeFeedback{}, fmt.Errorf("error parsing feedback response: %v", err)
+	}
+
+	// The reference answer comes from the card itself, not the model
+	feedback.CorrectAnswer = card.Match
+	feedback.Accepted = card.Accepted
+
+	feedbackCache.Put(key, feedback)
+
+	return feedback, nil
+}
@@ -2,23 +2,252 @@ package utils
 
 import (
 	"fmt"
+	"log"
 	"math"
+	"sync"
 )
 
-func Grade(pc *PineconeClient, cardId string, providedAnswer string) (float32, error) {
-	actualAnswerEmbed, err := pc.FetchAnswer(cardId)
-	if err != nil {
-		return 0, err
+const MAX_BATCH_GRADE = 100
+
+// At most this many of a batch's judge and feedback chat calls run at once,
+// so one batch can't hit OpenAI with hundreds of concurrent requests
+const MAX_CONCURRENT_CHAT_CALLS = 8
+
+func Grade(pc *PineconeClient, owner string, gradeRequest GradeRequest, policy GradingPolicy) (GradeResult, error) {
+	results, errs := GradeBatch(pc, owner, []GradeRequest{gradeRequest}, []GradingPolicy{policy})
+	return results[0], errs[0]
+}
+
+// GradeBatch grades many answers with one batched Pinecone fetch and one
+// embedding request. policies[i] applies to gradeRequests[i]. Failures are
+// per item, so one bad card doesn't fail the rest of the batch. Cards owner
+// doesn't own fail with ErrCardNotFound, the same as missing ones.
+func GradeBatch(pc *PineconeClient, owner string, gradeRequests []GradeRequest, policies []GradingPolicy) ([]GradeResult, []error) {
+	results := make([]GradeResult, len(gradeRequests))
+	errs := make([]error, len(gradeRequests))
+
+	// Cards still sitting in the outbox have no vector to grade against yet
+	statuses := make([]OutboxStatus, len(gradeRequests))
+	ob, obErr := GetOutbox()
+
+	cardIds := []string{}
+	for i, gradeRequest := range gradeRequests {
+		if obErr == nil {
+			if entry, ok := ob.Entry(gradeRequest.Uuid); ok {
+				if entry.Card.Owner != owner {
+					errs[i] = ErrCardNotFound
+					continue
+				}
+				statuses[i] = entry.Status
+			}
+		}
+
+		switch statuses[i] {
+		case OutboxPending:
+			errs[i] = ErrCardIndexing
+		case OutboxFailed:
+			errs[i] = ErrCardIndexFailed
+		default:
+			cardIds = append(cardIds, gradeRequest.Uuid)
+		}
+	}
+
+	storedCards := map[string]*StoredCard{}
+	if len(cardIds) > 0 {
+		var err error
+		storedCards, err = pc.FetchCards(cardIds)
+		if err != nil {
+			for i := range errs {
+				if errs[i] == nil {
+					errs[i] = err
+				}
+			}
+			return results, errs
+		}
+	}
+
+	for i, gradeRequest := range gradeRequests {
+		if errs[i] != nil {
+			continue
+		}
+
+		storedCard, ok := storedCards[gradeRequest.Uuid]
+		if ok && storedCard.Card.Owner != owner {
+			errs[i] = ErrCardNotFound
+			continue
+		}
+
+		if !ok {
+			if statuses[i] == OutboxIndexed {
+				// Upserted, but not visible to fetches yet
+				errs[i] = ErrCardIndexing
+			} else {
+				errs[i] = ErrCardNotFound
+			}
+		}
+	}
+
+	// A multiple-choice answer is one of the card's options, so it's graded by
+	// exact match and skips the judge, embedding and calibration entirely
+	exact := make([]bool, len(gradeRequests))
+	for i, gradeRequest := range gradeRequests {
+		if errs[i] != nil {
+			continue
+		}
+
+		if card := storedCards[gradeRequest.Uuid].Card; card.Type == CardMultipleChoice {
+			exact[i] = true
+			results[i] = GradeChoice(card, gradeRequest.Answer)
+		}
+	}
+
+	// The judge and feedback are separate chat calls, so they run alongside
+	// the embedding
+	judges := make([]JudgeResult, len(gradeRequests))
+	judgeErrs := make([]error, len(gradeRequests))
+	var wg sync.WaitGroup
+	chatCalls := make(chan struct{}, MAX_CONCURRENT_CHAT_CALLS)
+	for i, gradeRequest := range gradeRequests {
+		if errs[i] != nil || exact[i] {
+			continue
+		}
+
+		storedCard := storedCards[gradeRequest.Uuid]
+		results[i].Mode = policies[i].Mode
+
+		if policies[i].usesJudge() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				chatCalls <- struct{}{}
+				defer func() { <-chatCalls }()
+
+				judges[i], judgeErrs[i] = JudgeAnswer(storedCard.Card, gradeRequest.Answer)
+			}()
+		}
+
+		if gradeRequest.Feedback {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				chatCalls <- struct{}{}
+				defer func() { <-chatCalls }()
+
+				// Feedback is optional, so failing to produce it doesn't fail the grade
+				feedback, err := GenerateFeedback(storedCard.Card, gradeRequest.Answer)
+				if err != nil {
+					log.Println("Error generating grade feedback:", err)
+					return
+				}
+				results[i].Feedback = &feedback
+			}()
+		}
+	}
+
+	answers := []string{}
+	embedIndex := make([]int, len(gradeRequests))
+	for i, gradeRequest := range gradeRequests {
+		embedIndex[i] = -1
+		if errs[i] == nil && !exact[i] && policies[i].usesCosine() {
+			embedIndex[i] = len(answers)
+			answers = append(answers, gradeRequest.Answer)
+		}
+	}
+
+	var embeddings [][]float32
+	var embedErr error
+	if len(answers) > 0 {
+		embeddings, embedErr = GetEmbedCache().Embed(answers)
+	}
+
+	wg.Wait()
+
+	for i, err := range judgeErrs {
+		if errs[i] == nil && err != nil {
+			errs[i] = err
+		}
+	}
+
+	cosines := make([]float32, len(gradeRequests))
+	for i, gradeRequest := range gradeRequests {
+		if errs[i] != nil || embedIndex[i] < 0 {
+			continue
+		}
+
+		if embedErr != nil {
+			errs[i] = fmt.Errorf("unable to embed provided answer: %v", embedErr)
+			continue
+		}
+
+		// Grade against whichever accepted answer the response is closest to
+		provided := &embeddings[embedIndex[i]]
+		for j, answer := range storedCards[gradeRequest.Uuid].Answers {
+			similarity := CosineSimilarity(answer.Embedding, provided)
+			if j == 0 || similarity > cosines[i] {
+				cosines[i] = similarity
+				results[i].MatchedAnswer = answer.Answer
+				results[i].MatchedIndex = answer.Index
+			}
+		}
+		results[i].CosineGrade = &cosines[i]
+	}
+
+	var calibrations *CalibrationStore
+	if cs, err := GetCalibrationStore(); err == nil {
+		calibrations = cs
 	}
 
-	providedAnswerEmbed, err := MakeOpenAIEmbedRequest([]string{providedAnswer})
-	if err != nil {
-		return 0, fmt.Errorf("unable to embed provided answer: %v", err)
+	for i, gradeRequest := range gradeRequests {
+		if errs[i] != nil {
+			results[i] = GradeResult{}
+			continue
+		}
+
+		if exact[i] {
+			continue
+		}
+
+		results[i] = finishGrade(results[i], policies[i], cosines[i], judges[i], calibrations, gradeRequest)
+	}
+
+	return results, errs
+}
+
+// finishGrade combines the scores and applies calibration to produce the
+// final grade and verdict
+func finishGrade(result GradeResult, policy GradingPolicy, cosine float32, judge JudgeResult, calibrations *CalibrationStore, gradeRequest GradeRequest) GradeResult {
+	if policy.usesJudge() {
+		result.JudgeGrade = &judge.Score
+		result.Verdict = judge.Verdict
+		result.Reasoning = judge.Reasoning
 	}
 
-	var numericGrade float32 = CosineSimilarity(actualAnswerEmbed, &(*providedAnswerEmbed)[0].Embedding)
+	result.NumericGrade = policy.combine(cosine, judge)
+
+	// Whenever the judge grades, only a correct verdict can pass: an answer
+	// that's right but incomplete never does
+	if policy.usesJudge() {
+		passed := judge.Verdict == VerdictCorrect
+		result.Passed = &passed
+	}
+
+	if policy.usesCosine() {
+		calibration, scope := DefaultCalibration, ""
+		if calibrations != nil {
+			calibration, scope = calibrations.Lookup(gradeRequest.Uuid, gradeRequest.Deck)
+		}
+
+		calibrated, passed := calibration.Apply(cosine)
+		if policy.usesJudge() {
+			passed = passed && judge.Verdict == VerdictCorrect
+		}
+
+		result.CalibratedGrade = &calibrated
+		result.Passed = &passed
+		result.CalibrationScope = scope
+	}
 
-	return numericGrade, nil
+	return result
 }
 
 func CosineSimilarity(a, b *[]float32) float32 {
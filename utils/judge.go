@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type GradeMode string
+
+const (
+	GradeCosine   GradeMode = "cosine"
+	GradeJudge    GradeMode = "judge"
+	GradeCombined GradeMode = "combined"
+
+	// Multiple-choice cards are always graded exactly, whatever mode is requested
+	GradeExact GradeMode = "exact"
+)
+
+type Verdict string
+
+const (
+	VerdictCorrect   Verdict = "correct"
+	VerdictPartial   Verdict = "partial"
+	VerdictIncorrect Verdict = "incorrect"
+)
+
+// GradingPolicy controls how the cosine and judge scores are combined.
+// In combined mode the grade is a weighted average, except that a judge
+// verdict of incorrect caps the grade at IncorrectCap, since embeddings
+// can't tell "1945" from "1954" and shouldn't be able to outvote the judge.
+type GradingPolicy struct {
+	Mode         GradeMode
+	JudgeWeight  float32
+	IncorrectCap float32
+}
+
+const judgePrompt = `You are grading a flashcard answer. You will be given the card's question, the reference answer and the student's answer.
+
+Judge whether the student's answer means the same thing as the reference answer. If several reference answers are given, separated by slashes, matching any one of them is enough. Wording, spelling and level of detail may differ; facts, numbers, names and negations may not. An answer that is right but incomplete is partial.
+
+Respond with a score from 0 to 100, a verdict of "correct", "partial" or "incorrect", and one or two sentences of reasoning.`
+
+// DefaultGradingPolicy reads SANCTUM_GRADE_MODE and SANCTUM_JUDGE_WEIGHT,
+// falling back to cosine-only grading
+func DefaultGradingPolicy() GradingPolicy {
+	policy := GradingPolicy{
+		Mode:         GradeCosine,
+		JudgeWeight:  0.7,
+		IncorrectCap: 40,
+	}
+
+	if mode := GradeMode(os.Getenv("SANCTUM_GRADE_MODE")); mode.Valid() {
+		policy.Mode = mode
+	}
+
+	if weight, err := strconv.ParseFloat(os.Getenv("SANCTUM_JUDGE_WEIGHT"), 32); err == nil && weight >= 0 && weight <= 1 {
+		policy.JudgeWeight = float32(weight)
+	}
+
+	return policy
+}
+
+// WithOverrides applies the per-request mode and judge weight, if given
+func (policy GradingPolicy) WithOverrides(gradeRequest GradeRequest) (GradingPolicy, error) {
+	if gradeRequest.Mode != "" {
+		if !gradeRequest.Mode.Valid() {
+			return policy, fmt.Errorf("grade mode must be one of cosine, judge or combined")
+		}
+		policy.Mode = gradeRequest.Mode
+	}
+
+	if gradeRequest.JudgeWeight != nil {
+		if *gradeRequest.JudgeWeight < 0 || *gradeRequest.JudgeWeight > 1 {
+			return policy, fmt.Errorf("judge weight must be between 0 and 1")
+		}
+		policy.JudgeWeight = *gradeRequest.JudgeWeight
+	}
+
+	return policy, nil
+}
+
+func (mode GradeMode) Valid() bool {
+	switch mode {
+	case GradeCosine, GradeJudge, GradeCombined:
+		return true
+	}
+	return false
+}
+
+func (policy GradingPolicy) usesCosine() bool {
+	return policy.Mode == GradeCosine || policy.Mode == GradeCombined
+}
+
+func (policy GradingPolicy) usesJudge() bool {
+	return policy.Mode == GradeJudge || policy.Mode == GradeCombined
+}
+
+// combine produces the final grade from whichever scores the policy asked for
+func (policy GradingPolicy) combine(cosine float32, judge JudgeResult) float32 {
+	switch policy.Mode {
+	case GradeJudge:
+		return judge.Score
+	case GradeCombined:
+		grade := (1-policy.JudgeWeight)*cosine + policy.JudgeWeight*judge.Score
+		if judge.Verdict == VerdictIncorrect && grade > policy.IncorrectCap {
+			grade = policy.IncorrectCap
+		}
+		return grade
+	}
+	return cosine
+}
+
+func GetJudgeSchema() *ResponseFormat {
+	return &ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: JSONSchemaSpec{
+			Name: "grade",
+			Schema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"score":     map[string]any{"type": "number"},
+					"verdict":   map[string]any{"type": "string", "enum": []string{string(VerdictCorrect), string(VerdictPartial), string(VerdictIncorrect)}},
+					"reasoning": map[string]any{"type": "string"},
+				},
+				"required":             []string{"score", "verdict", "reasoning"},
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+// JudgeAnswer asks the chat model to grade providedAnswer against the card
+func JudgeAnswer(card Flashcard, providedAnswer string) (JudgeResult, error) {
+	if card.Match == "" {
+		return JudgeResult{}, fmt.Errorf("card %s has no stored answer text to judge against", card.Uuid)
+	}
+
+	messages := []Message{
+		{
+			Role:    "system",
+			Content: judgePrompt,
+		},
+		{
+			Role:    "user",
+			Content: fmt.Sprintf("Question: %s\nReference answer: %s\nStudent answer: %s", card.Pattern, strings.Join(card.Answers(), " / "), providedAnswer),
+		},
+	}
+
+	response, err := MakeOpenAIChatRequest(messages, GetJudgeSchema())
+	if err != nil {
+		return JudgeResult{}, fmt.Errorf("unable to judge answer: %v", err)
+	}
+
+	var result JudgeResult
+	if err := json.Unmarshal([]byte(response), &result); err != nil {
+		return JudgeResult{}, fmt.Errorf("error parsing judge response: %v", err)
+	}
+
+	result.Score = max(0, min(100, result.Score))
+
+	return result, nil
+}
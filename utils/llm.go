@@ -1,7 +1,7 @@
 package utils
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,10 +13,13 @@ const CHAT_ENDPOINT string = "https://api.openai.com/v1/chat/completions"
 const EMBED_ENDPOINT string = "https://api.openai.com/v1/embeddings"
 
 func MakeOpenAIRequest[T ChatRequest | EmbedRequest](reqBody T, endpoint string) (*http.Response, error) {
+	return makeOpenAIRequest(context.Background(), DefaultRetryPolicy, reqBody, endpoint)
+}
+
+func makeOpenAIRequest[T ChatRequest | EmbedRequest](ctx context.Context, policy RetryPolicy, reqBody T, endpoint string) (*http.Response, error) {
 	apiKey := os.Getenv("OPENAI_API_KEY")
 	if apiKey == "" {
-		fmt.Println("OPENAI_API_KEY environment variable not set")
-		return nil, nil
+		return nil, fmt.Errorf("OPENAI_API_KEY environment variable not set")
 	}
 
 	jsonData, err := json.Marshal(reqBody)
@@ -24,28 +27,70 @@ func MakeOpenAIRequest[T ChatRequest | EmbedRequest](reqBody T, endpoint string)
 		return nil, fmt.Errorf("error marshaling request: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
-	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Authorization", "Bearer "+apiKey)
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	return policy.DoRequest(ctx, http.MethodPost, endpoint, header, jsonData)
+}
 
-	client := &http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error making request: %v", err)
+// GetFlashcardSchema returns the structured output schema for generating
+// cards of the given type. Cloze cards come back as a single text field with
+// {{c1::...}} markers, which the server expands into sub-cards.
+func GetFlashcardSchema(cardType CardType) *ResponseFormat {
+	item := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"pattern": map[string]any{"type": "string"},
+			"match":   map[string]any{"type": "string"},
+			"accepted": map[string]any{
+				"type":  "array",
+				"items": map[string]any{"type": "string"},
+			},
+		},
+		"required":             []string{"pattern", "match", "accepted"},
+		"additionalProperties": false,
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("api request failed with status: %v", res.StatusCode)
+	if cardType == CardCloze {
+		item = map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"text": map[string]any{"type": "string"},
+			},
+			"required":             []string{"text"},
+			"additionalProperties": false,
+		}
 	}
 
-	return res, nil
-}
+	if cardType == CardMultipleChoice {
+		item = map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"pattern": map[string]any{"type": "string"},
+				"match":   map[string]any{"type": "string"},
+				"distractors": map[string]any{
+					"type":  "array",
+					"items": map[string]any{"type": "string"},
+				},
+			},
+			"required":             []string{"pattern", "match", "distractors"},
+			"additionalProperties": false,
+		}
+	}
+
+	// Every card type is tagged and rated by the model
+	properties := item["properties"].(map[string]any)
+	properties["tags"] = map[string]any{
+		"type":  "array",
+		"items": map[string]any{"type": "string"},
+	}
+	properties["difficulty"] = map[string]any{
+		"type": "string",
+		"enum": []string{string(DifficultyEasy), string(DifficultyMedium), string(DifficultyHard)},
+	}
+	item["required"] = append(item["required"].([]string), "tags", "difficulty")
 
-func GetFlashcardSchema() *ResponseFormat {
 	return &ResponseFormat{
 		Type: "json_schema",
 		JSONSchema: JSONSchemaSpec{
@@ -54,16 +99,8 @@ func GetFlashcardSchema() *ResponseFormat {
 				"type": "object",
 				"properties": map[string]any{
 					"cards": map[string]any{
-						"type": "array",
-						"items": map[string]any{
-							"type": "object",
-							"properties": map[string]any{
-								"pattern": map[string]any{"type": "string"},
-								"match":   map[string]any{"type": "string"},
-							},
-							"required":             []string{"pattern", "match"},
-							"additionalProperties": false,
-						},
+						"type":  "array",
+						"items": item,
 					},
 				},
 				"required":             []string{"cards"},
@@ -109,12 +146,12 @@ func MakeOpenAIChatRequest(messages []Message, responseFormat *ResponseFormat) (
 func MakeOpenAIEmbedRequest(text []string) (*[]EmbedData, error) {
 	reqBody := EmbedRequest{
 		Input: text,
-		Model: "text-embedding-3-small",
+		Model: EMBED_MODEL,
 	}
 
 	res, err := MakeOpenAIRequest(reqBody, EMBED_ENDPOINT)
 	if err != nil {
-		return nil, fmt.Errorf("error making request to OpenAI Embed endpoint: %v", err)
+		return nil, fmt.Errorf("error making request to OpenAI Embed endpoint: %w", err)
 	}
 
 	defer res.Body.Close()
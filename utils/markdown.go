@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ParseError is a problem with one line of an imported file, or one note of
+// an Anki package. Line counts from 1; whatever failed to parse is skipped
+// and the rest still imports.
+type ParseError struct {
+	Line    int    `json:"line,omitempty"`
+	Note    int64  `json:"note,omitempty"`
+	Message string `json:"message"`
+}
+
+var (
+	questionPattern  = regexp.MustCompile(`(?i)^(?:q|question):\s*(.*)$`)
+	answerPattern    = regexp.MustCompile(`(?i)^(?:a|answer):\s*(.*)$`)
+	acceptedPattern  = regexp.MustCompile(`(?i)^also accepted:\s*(.*)$`)
+	optionsPattern   = regexp.MustCompile(`(?i)^options:$`)
+	highlightPattern = regexp.MustCompile(`==([^=]+?)==`)
+	listPattern      = regexp.MustCompile(`^(?:[-*+]|\d+[.)])\s+`)
+
+	// "::" only separates a card with space around it, so std::vector and
+	// Foo::bar in prose aren't cards
+	separatorPattern = regexp.MustCompile(`(?:^|\s)::(?:\s|$)`)
+	codeSpanPattern  = regexp.MustCompile("`+[^`]*`+")
+)
+
+// maskCodeSpans blanks out inline code spans, keeping the line's length so
+// positions found in the masked line still apply to the original
+func maskCodeSpans(line string) string {
+	return codeSpanPattern.ReplaceAllStringFunc(line, func(span string) string {
+		return strings.Repeat(" ", len(span))
+	})
+}
+
+// countDistractors counts the options that aren't the answer or an accepted
+// alternative
+func countDistractors(options []string, answer []string, accepted []string) int {
+	isAnswer := map[string]bool{normalizeChoice(strings.Join(answer, "\n")): true}
+	for _, alternative := range accepted {
+		isAnswer[normalizeChoice(alternative)] = true
+	}
+
+	count := 0
+	for _, option := range options {
+		if !isAnswer[normalizeChoice(option)] {
+			count += 1
+		}
+	}
+	return count
+}
+
+// ParseMarkdownCards finds the flashcards written inline in a Markdown note.
+// It understands
+//
+//	Question :: Answer
+//
+//	Q: Question
+//	Options:
+//	- An option, making it a multiple-choice card
+//	A: Answer, which may run over several lines until a blank one
+//	Also accepted: Another answer; and another
+//
+//	A question paragraph
+//	?
+//	An answer paragraph
+//
+// and turns lines with ==highlights== into cloze notes, one deletion per
+// highlight. Front matter, fenced code blocks and inline code spans are
+// skipped. This reads back the Markdown that deck export writes.
+func ParseMarkdownCards(text string) ([]Flashcard, []ParseError) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	cards := []Flashcard{}
+	errs := []ParseError{}
+
+	// keep adds a card found at line, unless it's too long to store
+	keep := func(line int, card Flashcard) {
+		if err := card.Validate(); err != nil {
+			errs = append(errs, ParseError{Line: line, Message: err.Error()})
+			return
+		}
+		cards = append(cards, card)
+	}
+
+	// Lines since the last blank line that weren't cards themselves; the
+	// question of a "?" card
+	paragraph := []string{}
+	paragraphStart := 0
+
+	// The Q:/A: card being read, if any
+	var question, answer, accepted, options []string
+	questionLine := 0
+	inOptions := false
+	inAnswer := false
+
+	finishQuestion := func() {
+		if questionLine == 0 {
+			return
+		}
+
+		switch {
+		case !inAnswer:
+			errs = append(errs, ParseError{Line: questionLine, Message: "Q: has no matching A:"})
+		case strings.TrimSpace(strings.Join(question, "\n")) == "":
+			errs = append(errs, ParseError{Line: questionLine, Message: "Q: has an empty question"})
+		case strings.TrimSpace(strings.Join(answer, "\n")) == "":
+			errs = append(errs, ParseError{Line: questionLine, Message: "A: has an empty answer"})
+		case len(options) > 0 && countDistractors(options, answer, accepted) < MIN_DISTRACTORS:
+			errs = append(errs, ParseError{Line: questionLine, Message: fmt.Sprintf("multiple-choice Q: needs at least %d options besides the answer", MIN_DISTRACTORS)})
+		default:
+			card := Flashcard{
+				Pattern:  strings.TrimSpace(strings.Join(question, "\n")),
+				Match:    strings.TrimSpace(strings.Join(answer, "\n")),
+				Accepted: accepted,
+			}
+			if len(options) > 0 {
+				card.Type = CardMultipleChoice
+				card.Options = options
+			}
+			keep(questionLine, card)
+		}
+
+		question, answer, accepted, options = nil, nil, nil, nil
+		questionLine = 0
+		inOptions = false
+		inAnswer = false
+	}
+
+	inFence := false
+	for i := 0; i < len(lines); i += 1 {
+		lineNumber := i + 1
+		line := strings.TrimSpace(lines[i])
+
+		// Front matter
+		if i == 0 && line == "---" {
+			end := 1
+			for end < len(lines) && strings.TrimSpace(lines[end]) != "---" {
+				end += 1
+			}
+
+			// Unclosed front matter is more likely a rule than metadata, so the
+			// rest of the file is still read as notes
+			if end == len(lines) {
+				errs = append(errs, ParseError{Line: lineNumber, Message: "front matter is never closed"})
+				continue
+			}
+
+			i = end
+			continue
+		}
+
+		if strings.HasPrefix(line, "```") || strings.HasPrefix(line, "~~~") {
+			finishQuestion()
+			paragraph = nil
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			continue
+		}
+
+		if line == "" {
+			finishQuestion()
+			paragraph = nil
+			continue
+		}
+
+		if match := questionPattern.FindStringSubmatch(line); match != nil {
+			finishQuestion()
+			paragraph = nil
+			questionLine = lineNumber
+			question = []string{match[1]}
+			continue
+		}
+
+		if questionLine != 0 {
+			if match := answerPattern.FindStringSubmatch(line); match != nil && !inAnswer {
+				inAnswer = true
+				answer = []string{match[1]}
+			} else if match := acceptedPattern.FindStringSubmatch(line); match != nil && inAnswer {
+				accepted = append(accepted, splitList(match[1])...)
+			} else if inAnswer {
+				answer = append(answer, line)
+			} else if optionsPattern.MatchString(line) {
+				inOptions = true
+			} else if inOptions && listPattern.MatchString(line) {
+				options = append(options, listPattern.ReplaceAllString(line, ""))
+			} else {
+				question = append(question, line)
+			}
+			continue
+		}
+
+		if match := answerPattern.FindStringSubmatch(line); match != nil {
+			errs = append(errs, ParseError{Line: lineNumber, Message: "A: has no matching Q:"})
+			paragraph = nil
+			continue
+		}
+
+		if line == "?" {
+			if len(paragraph) == 0 {
+				errs = append(errs, ParseError{Line: lineNumber, Message: "? separator has no question above it"})
+				continue
+			}
+
+			answerLines := []string{}
+			for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+				i += 1
+				answerLines = append(answerLines, strings.TrimSpace(lines[i]))
+			}
+
+			if len(answerLines) == 0 {
+				errs = append(errs, ParseError{Line: paragraphStart, Message: "? separator has no answer below it"})
+			} else {
+				keep(paragraphStart, Flashcard{
+					Pattern: strings.Join(paragraph, "\n"),
+					Match:   strings.Join(answerLines, "\n"),
+				})
+			}
+
+			paragraph = nil
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			paragraph = nil
+			continue
+		}
+
+		item := listPattern.ReplaceAllString(line, "")
+
+		if separator := separatorPattern.FindStringIndex(maskCodeSpans(item)); separator != nil && !strings.Contains(item, "{{c") {
+			pattern, match := strings.TrimSpace(item[:separator[0]]), strings.TrimSpace(item[separator[1]:])
+			if pattern == "" || match == "" {
+				errs = append(errs, ParseError{Line: lineNumber, Message: ":: card needs text on both sides"})
+			} else {
+				keep(lineNumber, Flashcard{Pattern: pattern, Match: match})
+			}
+			paragraph = nil
+			continue
+		}
+
+		if highlightPattern.MatchString(item) {
+			index := 0
+			note := highlightPattern.ReplaceAllStringFunc(item, func(highlight string) string {
+				index += 1
+				return fmt.Sprintf("{{c%d::%s}}", index, strings.TrimSpace(highlightPattern.FindStringSubmatch(highlight)[1]))
+			})
+
+			if _, err := ParseCloze(note); err != nil {
+				errs = append(errs, ParseError{Line: lineNumber, Message: err.Error()})
+			} else {
+				keep(lineNumber, Flashcard{Type: CardCloze, Text: note})
+			}
+			paragraph = nil
+			continue
+		}
+
+		if len(paragraph) == 0 {
+			paragraphStart = lineNumber
+		}
+		paragraph = append(paragraph, item)
+	}
+
+	finishQuestion()
+
+	return cards, errs
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMarkdownCards(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		cards []Flashcard
+		lines []int
+	}{
+		{
+			name:  "double colon",
+			text:  "Capital of France :: Paris",
+			cards: []Flashcard{{Pattern: "Capital of France", Match: "Paris"}},
+		},
+		{
+			name:  "double colon in a list item",
+			text:  "- Capital of France :: Paris\n- Capital of Spain :: Madrid",
+			cards: []Flashcard{{Pattern: "Capital of France", Match: "Paris"}, {Pattern: "Capital of Spain", Match: "Madrid"}},
+		},
+		{
+			name: "double colon without spaces isn't a card",
+			text: "Use std::vector or Foo::bar here",
+		},
+		{
+			name: "double colon in a code span isn't a card",
+			text: "Call `Foo :: bar` to start",
+		},
+		{
+			name:  "double colon outside a code span",
+			text:  "What does `len` return? :: The length",
+			cards: []Flashcard{{Pattern: "What does `len` return?", Match: "The length"}},
+		},
+		{
+			name:  "double colon with one side empty",
+			text:  "Capital of France ::",
+			lines: []int{1},
+		},
+		{
+			name:  "question and answer",
+			text:  "Q: Capital of France?\nA: Paris",
+			cards: []Flashcard{{Pattern: "Capital of France?", Match: "Paris"}},
+		},
+		{
+			name:  "multi-line answer",
+			text:  "Q: Primary colours?\nA: Red\nYellow\nBlue\n\nQ: Next?\nA: Yes",
+			cards: []Flashcard{{Pattern: "Primary colours?", Match: "Red\nYellow\nBlue"}, {Pattern: "Next?", Match: "Yes"}},
+		},
+		{
+			name:  "list lines in a question stay in the question",
+			text:  "Q: Which of these is a prime?\n- 4\n- 7\n* 9\n1. 10\nA: 7",
+			cards: []Flashcard{{Pattern: "Which of these is a prime?\n- 4\n- 7\n* 9\n1. 10", Match: "7"}},
+		},
+		{
+			name: "options after an Options: line",
+			text: "Q: Which of these is a prime?\nOptions:\n- 4\n- 7\n- 9\nA: 7",
+			cards: []Flashcard{{
+				Type:    CardMultipleChoice,
+				Pattern: "Which of these is a prime?",
+				Match:   "7",
+				Options: []string{"4", "7", "9"},
+			}},
+		},
+		{
+			name:  "too few options",
+			text:  "Q: Which of these is a prime?\nOptions:\n- 4\n- 7\nA: 7",
+			lines: []int{1},
+		},
+		{
+			name:  "accepted answers",
+			text:  "Q: Who launched Sputnik?\nA: USSR\nAlso accepted: Soviet Union; the Soviets",
+			cards: []Flashcard{{Pattern: "Who launched Sputnik?", Match: "USSR", Accepted: []string{"Soviet Union", "the Soviets"}}},
+		},
+		{
+			name:  "question without an answer",
+			text:  "Q: Capital of France?\n\nQ: Capital of Spain?\nA: Madrid",
+			cards: []Flashcard{{Pattern: "Capital of Spain?", Match: "Madrid"}},
+			lines: []int{1},
+		},
+		{
+			name:  "answer without a question",
+			text:  "A: Paris",
+			lines: []int{1},
+		},
+		{
+			name:  "question mark separator",
+			text:  "What is the capital\nof France?\n?\nParis",
+			cards: []Flashcard{{Pattern: "What is the capital\nof France?", Match: "Paris"}},
+		},
+		{
+			name:  "question mark separator without an answer",
+			text:  "What is the capital of France?\n?",
+			lines: []int{1},
+		},
+		{
+			name:  "highlights become a cloze note",
+			text:  "The ==mitochondria== is the ==powerhouse== of the cell",
+			cards: []Flashcard{{Type: CardCloze, Text: "The {{c1::mitochondria}} is the {{c2::powerhouse}} of the cell"}},
+		},
+		{
+			name:  "front matter is skipped",
+			text:  "---\ntitle: Cells :: Biology\n---\nCell :: Unit of life",
+			cards: []Flashcard{{Pattern: "Cell", Match: "Unit of life"}},
+		},
+		{
+			name:  "unclosed front matter is reported and the rest still parsed",
+			text:  "---\nCell :: Unit of life",
+			cards: []Flashcard{{Pattern: "Cell", Match: "Unit of life"}},
+			lines: []int{1},
+		},
+		{
+			name:  "fenced code is skipped",
+			text:  "```\nA :: B\n```\nC :: D",
+			cards: []Flashcard{{Pattern: "C", Match: "D"}},
+		},
+		{
+			name:  "card too long to store",
+			text:  "Q: " + strings.Repeat("x", MAX_CARD_TEXT_LENGTH+1) + "\nA: y",
+			lines: []int{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cards, errs := ParseMarkdownCards(tt.text)
+
+			if tt.cards == nil {
+				tt.cards = []Flashcard{}
+			}
+			if !reflect.DeepEqual(cards, tt.cards) {
+				t.Errorf("cards = %+v, want %+v", cards, tt.cards)
+			}
+
+			lines := []int{}
+			for _, err := range errs {
+				lines = append(lines, err.Line)
+			}
+			if tt.lines == nil {
+				tt.lines = []int{}
+			}
+			if !reflect.DeepEqual(lines, tt.lines) {
+				t.Errorf("errors on lines %v, want %v: %+v", lines, tt.lines, errs)
+			}
+		})
+	}
+}
+
+func TestExportMarkdownRoundTrip(t *testing.T) {
+	deck := FlashcardDeck{
+		Title: "Round trip",
+		Cards: []Flashcard{
+			{Pattern: "Who launched Sputnik?", Match: "USSR", Accepted: []string{"Soviet Union", "the Soviets"}},
+			{Type: CardMultipleChoice, Pattern: "Which is a prime?", Match: "7", Options: []string{"4", "7", "9"}},
+			{Pattern: "Bulleted context:\n- one\n- two", Match: "Both"},
+		},
+	}
+
+	cards, errs := ParseMarkdownCards(string(exportMarkdown(deck)))
+	if len(errs) > 0 {
+		t.Fatalf("errors reading the export back: %+v", errs)
+	}
+	if !reflect.DeepEqual(cards, deck.Cards) {
+		t.Errorf("read back %+v, want %+v", cards, deck.Cards)
+	}
+}
@@ -0,0 +1,341 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const OUTBOX_DEFAULT_PATH = "outbox.json"
+
+// Cards are indexed in batches of this size, and given up on after
+// OUTBOX_MAX_ATTEMPTS failed passes. AddCards splits a batch's embedding
+// and upsert requests further, and a batch that's rejected is split in half
+// until the cards that can't be indexed are found on their own, so one bad
+// card doesn't fail the rest of its batch.
+const OUTBOX_BATCH_SIZE = 500
+const OUTBOX_MAX_ATTEMPTS = 8
+
+// Indexed entries are kept around for a while so /grade can tell a card that
+// was just upserted (and may not be queryable yet) from one that never existed
+const OUTBOX_RETENTION = time.Hour
+
+type OutboxStatus string
+
+const (
+	OutboxPending OutboxStatus = "pending"
+	OutboxIndexed OutboxStatus = "indexed"
+	OutboxFailed  OutboxStatus = "failed"
+
+	// Removed entries are kept, like indexed ones, so a flush that was
+	// already upserting the card when it was removed can delete it again
+	OutboxRemoved OutboxStatus = "removed"
+)
+
+var ErrCardIndexing = errors.New("card is still being indexed")
+var ErrCardIndexFailed = errors.New("card could not be indexed")
+
+type OutboxEntry struct {
+	Card      Flashcard    `json:"card"`
+	Status    OutboxStatus `json:"status"`
+	Attempts  int          `json:"attempts"`
+	LastError string       `json:"lastError,omitempty"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+// Outbox is a file-backed queue of cards waiting to be embedded and upserted.
+// Cards are written here before anything talks to OpenAI or Pinecone, so a
+// failed upstream call never loses generated cards.
+type Outbox struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]*OutboxEntry
+	wake    chan struct{}
+}
+
+var (
+	outboxInstance *Outbox
+	outboxOnce     sync.Once
+	outboxErr      error
+)
+
+func GetOutbox() (*Outbox, error) {
+	outboxOnce.Do(func() {
+		path := os.Getenv("SANCTUM_OUTBOX_PATH")
+		if path == "" {
+			path = OUTBOX_DEFAULT_PATH
+		}
+
+		outboxInstance, outboxErr = OpenOutbox(path)
+		if outboxErr == nil {
+			go outboxInstance.run()
+		}
+	})
+
+	return outboxInstance, outboxErr
+}
+
+func OpenOutbox(path string) (*Outbox, error) {
+	ob := &Outbox{
+		path:    path,
+		entries: map[string]*OutboxEntry{},
+		wake:    make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ob, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &ob.entries); err != nil {
+		return nil, fmt.Errorf("error parsing outbox: %v", err)
+	}
+
+	return ob, nil
+}
+
+// Enqueue durably records the cards as pending and wakes the indexer
+func (ob *Outbox) Enqueue(cards []Flashcard) error {
+	for _, card := range cards {
+		if card.Uuid == "" {
+			return fmt.Errorf("Flashcard UUID is not set")
+		}
+	}
+
+	ob.mu.Lock()
+	now := time.Now()
+	previous := map[string]*OutboxEntry{}
+	for _, card := range cards {
+		previous[card.Uuid] = ob.entries[card.Uuid]
+		ob.entries[card.Uuid] = &OutboxEntry{
+			Card:      card,
+			Status:    OutboxPending,
+			UpdatedAt: now,
+		}
+	}
+	err := ob.save()
+
+	// Cards that couldn't be saved aren't queued, so a flush mustn't index them
+	if err != nil {
+		for cardId, entry := range previous {
+			if entry == nil {
+				delete(ob.entries, cardId)
+			} else {
+				ob.entries[cardId] = entry
+			}
+		}
+	}
+	ob.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Entry reports where a card is in the indexing pipeline. ok is false for
+// cards the outbox doesn't know about (old cards, or ones pruned after
+// indexing) and for removed cards.
+func (ob *Outbox) Entry(cardId string) (OutboxEntry, bool) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	entry, ok := ob.entries[cardId]
+	if !ok || entry.Status == OutboxRemoved {
+		return OutboxEntry{}, false
+	}
+
+	return *entry, true
+}
+
+// Remove marks a card as removed so it isn't indexed later. If a flush is
+// upserting it right now, the flush deletes it again once the upsert is done.
+func (ob *Outbox) Remove(cardId string) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	entry, ok := ob.entries[cardId]
+	if !ok {
+		return nil
+	}
+
+	entry.Status = OutboxRemoved
+	entry.UpdatedAt = time.Now()
+	return ob.save()
+}
+
+// save writes the outbox to disk; callers must hold ob.mu
+func (ob *Outbox) save() error {
+	data, err := json.Marshal(ob.entries)
+	if err != nil {
+		return fmt.Errorf("error encoding outbox: %v", err)
+	}
+
+	if err := writeFileAtomic(ob.path, data); err != nil {
+		return fmt.Errorf("error writing outbox: %v", err)
+	}
+
+	return nil
+}
+
+func (ob *Outbox) pending() []Flashcard {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	cards := []Flashcard{}
+	for _, entry := range ob.entries {
+		if entry.Status == OutboxPending {
+			cards = append(cards, entry.Card)
+		}
+	}
+
+	return cards
+}
+
+// mark records the outcome of indexing cards, returning those that were
+// removed while they were being indexed
+func (ob *Outbox) mark(cards []Flashcard, indexErr error) []string {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	removed := []string{}
+	now := time.Now()
+	for _, card := range cards {
+		entry, ok := ob.entries[card.Uuid]
+		if !ok {
+			continue
+		}
+		if entry.Status == OutboxRemoved {
+			removed = append(removed, card.Uuid)
+			continue
+		}
+
+		entry.UpdatedAt = now
+		if indexErr == nil {
+			entry.Status = OutboxIndexed
+			entry.LastError = ""
+			continue
+		}
+
+		entry.Attempts += 1
+		entry.LastError = indexErr.Error()
+		if entry.Attempts >= OUTBOX_MAX_ATTEMPTS {
+			entry.Status = OutboxFailed
+		}
+	}
+
+	for id, entry := range ob.entries {
+		done := entry.Status == OutboxIndexed || entry.Status == OutboxRemoved
+		if done && now.Sub(entry.UpdatedAt) > OUTBOX_RETENTION {
+			delete(ob.entries, id)
+		}
+	}
+
+	if err := ob.save(); err != nil {
+		log.Println("Error saving outbox:", err)
+	}
+
+	return removed
+}
+
+// flush makes one pass over the pending cards, returning whether anything failed
+func (ob *Outbox) flush() bool {
+	cards := ob.pending()
+	if len(cards) == 0 {
+		return false
+	}
+
+	pc, err := GetPineconeClient()
+	if err != nil {
+		log.Println("Outbox unable to connect to Pinecone:", err)
+		ob.mark(cards, err)
+		return true
+	}
+
+	failed := false
+	for start := 0; start < len(cards); start += OUTBOX_BATCH_SIZE {
+		if ob.index(pc, cards[start:min(start+OUTBOX_BATCH_SIZE, len(cards))]) {
+			failed = true
+		}
+	}
+
+	return failed
+}
+
+// rejectsContent reports whether err is OpenAI or Pinecone rejecting the
+// request itself, which some card in it can be to blame for. Anything else,
+// like an outage or a bad API key, would fail any batch.
+func rejectsContent(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusBadRequest
+	}
+	return status.Code(err) == codes.InvalidArgument
+}
+
+// index upserts cards and marks the outcome, returning whether any failed.
+// A batch whose content is rejected is split in half and each half tried on
+// its own; any other failure marks the whole batch and is left to the next
+// pass.
+func (ob *Outbox) index(pc *PineconeClient, cards []Flashcard) bool {
+	_, err := pc.AddCards(cards)
+
+	if err != nil && len(cards) > 1 && rejectsContent(err) {
+		half := len(cards) / 2
+		first := ob.index(pc, cards[:half])
+		second := ob.index(pc, cards[half:])
+		return first || second
+	}
+
+	if err != nil {
+		log.Printf("Outbox failed to index %d cards: %v", len(cards), err)
+	}
+
+	for _, cardId := range ob.mark(cards, err) {
+		if _, err := pc.RemoveCard(cardId); err != nil {
+			log.Printf("Outbox failed to delete removed card %s: %v", cardId, err)
+		}
+	}
+
+	return err != nil
+}
+
+// run drains the outbox whenever cards are enqueued, backing off between
+// passes while upstream calls keep failing
+func (ob *Outbox) run() {
+	failures := 0
+	for {
+		if ob.flush() {
+			failures += 1
+		} else {
+			failures = 0
+		}
+
+		if failures == 0 {
+			<-ob.wake
+			continue
+		}
+
+		select {
+		case <-ob.wake:
+		case <-time.After(DefaultRetryPolicy.backoff(failures) + DefaultRetryPolicy.BaseDelay):
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	DEFAULT_DECK_SIZE = 20
+	MAX_DECK_SIZE     = 200
+)
+
+// An outline with more subtopics than this spreads a deck too thin to cover
+// any of them
+const MAX_OUTLINE_SUBTOPICS = 12
+
+// Subtopic weights are the model's 1-5 rating of how much of the deck a
+// subtopic deserves
+const (
+	MIN_SUBTOPIC_WEIGHT = 1
+	MAX_SUBTOPIC_WEIGHT = 5
+)
+
+// Subtopic is one entry of a deck's outline. Cards is how many cards it
+// should get, shared out from the deck's size by weight.
+type Subtopic struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Weight      int    `json:"weight"`
+	Cards       int    `json:"cards"`
+}
+
+func GetOutlineSchema() *ResponseFormat {
+	return &ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: JSONSchemaSpec{
+			Name: "deck_outline",
+			Schema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"subtopics": map[string]any{
+						"type": "array",
+						"items": map[string]any{
+							"type": "object",
+							"properties": map[string]any{
+								"title":       map[string]any{"type": "string"},
+								"description": map[string]any{"type": "string"},
+								"weight":      map[string]any{"type": "integer"},
+							},
+							"required":             []string{"title", "description", "weight"},
+							"additionalProperties": false,
+						},
+					},
+				},
+				"required":             []string{"subtopics"},
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+// NewOutline trims the subtopics, dropping empty and repeated ones and any
+// past MAX_OUTLINE_SUBTOPICS or size, then shares size cards out between them
+func NewOutline(subtopics []Subtopic, size int) []Subtopic {
+	outline := []Subtopic{}
+	seen := map[string]bool{}
+	for _, subtopic := range subtopics {
+		subtopic.Title = strings.TrimSpace(subtopic.Title)
+		subtopic.Description = strings.TrimSpace(subtopic.Description)
+
+		key := strings.ToLower(subtopic.Title)
+		if key == "" || seen[key] {
+			continue
+		}
+		if len(outline) == min(MAX_OUTLINE_SUBTOPICS, size) {
+			break
+		}
+
+		seen[key] = true
+		subtopic.Weight = max(MIN_SUBTOPIC_WEIGHT, min(MAX_SUBTOPIC_WEIGHT, subtopic.Weight))
+		outline = append(outline, subtopic)
+	}
+
+	allocateCards(outline, size, 1)
+
+	return outline
+}
+
+// ResizeOutline shares size cards out between a saved outline's subtopics by
+// weight. Unlike NewOutline it keeps every subtopic, so an outline with more
+// subtopics than size leaves some of them with no cards.
+func ResizeOutline(outline []Subtopic, size int) []Subtopic {
+	resized := append([]Subtopic{}, outline...)
+	for i := range resized {
+		resized[i].Weight = max(MIN_SUBTOPIC_WEIGHT, min(MAX_SUBTOPIC_WEIGHT, resized[i].Weight))
+	}
+
+	allocateCards(resized, size, 0)
+
+	return resized
+}
+
+// allocateCards gives every subtopic minimum cards and shares the rest out
+// in proportion to weight, handing leftovers to the largest remainders so
+// the counts add up to size exactly
+func allocateCards(outline []Subtopic, size int, minimum int) {
+	if len(outline) == 0 {
+		return
+	}
+
+	totalWeight := 0
+	for i := range outline {
+		outline[i].Cards = minimum
+		totalWeight += outline[i].Weight
+	}
+
+	spare := size - minimum*len(outline)
+	remainders := make([]int, len(outline))
+	given := 0
+	for i := range outline {
+		share := spare * outline[i].Weight
+		outline[i].Cards += share / totalWeight
+		remainders[i] = share % totalWeight
+		given += share / totalWeight
+	}
+
+	for ; given < spare; given += 1 {
+		largest := 0
+		for i := range remainders {
+			if remainders[i] > remainders[largest] {
+				largest = i
+			}
+		}
+		outline[largest].Cards += 1
+		remainders[largest] = -1
+	}
+}
+
+// GenerateOutline asks the chat model for the outline of a deck described
+// by messages, with size cards shared out between its subtopics
+func GenerateOutline(messages []Message, size int) ([]Subtopic, error) {
+	response, err := MakeOpenAIChatRequest(messages, GetOutlineSchema())
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Subtopics []Subtopic `json:"subtopics"`
+	}
+	if err := json.Unmarshal([]byte(response), &parsed); err != nil {
+		return nil, fmt.Errorf("error parsing deck outline: %v", err)
+	}
+
+	outline := NewOutline(parsed.Subtopics, size)
+	if len(outline) == 0 {
+		return nil, fmt.Errorf("deck outline has no subtopics")
+	}
+
+	return outline, nil
+}
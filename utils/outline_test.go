@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func sumCards(outline []Subtopic) int {
+	total := 0
+	for _, subtopic := range outline {
+		total += subtopic.Cards
+	}
+	return total
+}
+
+func TestResizeOutline(t *testing.T) {
+	saved := []Subtopic{}
+	for i := 1; i <= 10; i += 1 {
+		saved = append(saved, Subtopic{Title: fmt.Sprintf("Subtopic %d", i), Weight: 3})
+	}
+	saved[9].Weight = 5
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"fewer cards than subtopics", 5},
+		{"one card per subtopic", 10},
+		{"more cards than subtopics", 37},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resized := ResizeOutline(saved, tt.size)
+
+			if len(resized) != len(saved) {
+				t.Fatalf("got %d subtopics, want all %d", len(resized), len(saved))
+			}
+			if total := sumCards(resized); total != tt.size {
+				t.Errorf("cards add up to %d, want %d", total, tt.size)
+			}
+			for i := range resized {
+				if resized[i].Title != saved[i].Title {
+					t.Errorf("subtopic %d is %q, want %q", i, resized[i].Title, saved[i].Title)
+				}
+				if resized[i].Cards < 0 {
+					t.Errorf("%s has %d cards", resized[i].Title, resized[i].Cards)
+				}
+			}
+		})
+	}
+
+	if saved[0].Cards != 0 {
+		t.Errorf("ResizeOutline changed the saved outline")
+	}
+
+	// The heaviest subtopic gets the first of too few cards
+	if resized := ResizeOutline(saved, 1); resized[9].Cards != 1 {
+		t.Errorf("heaviest subtopic got %d of 1 card, want 1", resized[9].Cards)
+	}
+}
+
+func TestAllocateCards(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		size    int
+		minimum int
+		want    []int
+	}{
+		{"even weights", []int{1, 1, 1, 1}, 8, 1, []int{2, 2, 2, 2}},
+		{"proportional", []int{3, 1}, 20, 1, []int{15, 5}},
+		{"leftover to the largest remainder", []int{2, 1}, 5, 1, []int{3, 2}},
+		{"one card each", []int{5, 1, 3}, 3, 1, []int{1, 1, 1}},
+		{"no minimum", []int{5, 1, 3}, 2, 0, []int{1, 0, 1}},
+		{"no minimum and no cards", []int{2, 2}, 0, 0, []int{0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outline := []Subtopic{}
+			for _, weight := range tt.weights {
+				outline = append(outline, Subtopic{Weight: weight})
+			}
+
+			allocateCards(outline, tt.size, tt.minimum)
+
+			got := []int{}
+			for _, subtopic := range outline {
+				got = append(got, subtopic.Cards)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cards = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewOutline(t *testing.T) {
+	many := []Subtopic{}
+	for i := 1; i <= MAX_OUTLINE_SUBTOPICS+3; i += 1 {
+		many = append(many, Subtopic{Title: fmt.Sprintf("Subtopic %d", i), Weight: 1})
+	}
+
+	tests := []struct {
+		name      string
+		subtopics []Subtopic
+		size      int
+		titles    []string
+	}{
+		{
+			name:      "trims and drops empty and repeated titles",
+			subtopics: []Subtopic{{Title: "  Cells "}, {Title: ""}, {Title: "cells"}, {Title: "Genetics"}},
+			size:      10,
+			titles:    []string{"Cells", "Genetics"},
+		},
+		{
+			name:      "no more subtopics than cards",
+			subtopics: []Subtopic{{Title: "A"}, {Title: "B"}, {Title: "C"}, {Title: "D"}},
+			size:      2,
+			titles:    []string{"A", "B"},
+		},
+		{
+			name:      "at most MAX_OUTLINE_SUBTOPICS",
+			subtopics: many,
+			size:      100,
+			titles: func() []string {
+				titles := []string{}
+				for _, subtopic := range many[:MAX_OUTLINE_SUBTOPICS] {
+					titles = append(titles, subtopic.Title)
+				}
+				return titles
+			}(),
+		},
+		{
+			name:      "nothing left",
+			subtopics: []Subtopic{{Title: " "}},
+			size:      10,
+			titles:    []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outline := NewOutline(tt.subtopics, tt.size)
+
+			titles := []string{}
+			for _, subtopic := range outline {
+				titles = append(titles, subtopic.Title)
+				if subtopic.Weight < MIN_SUBTOPIC_WEIGHT || subtopic.Weight > MAX_SUBTOPIC_WEIGHT {
+					t.Errorf("%s has weight %d", subtopic.Title, subtopic.Weight)
+				}
+				if subtopic.Cards < 1 {
+					t.Errorf("%s has %d cards", subtopic.Title, subtopic.Cards)
+				}
+			}
+			if !reflect.DeepEqual(titles, tt.titles) {
+				t.Errorf("titles = %q, want %q", titles, tt.titles)
+			}
+			if len(outline) > 0 && sumCards(outline) != tt.size {
+				t.Errorf("cards add up to %d, want %d", sumCards(outline), tt.size)
+			}
+		})
+	}
+}
@@ -7,71 +7,475 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pinecone-io/go-pinecone/v3/pinecone"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 const LOGGING = false
 
 const PINECONE_NAMESPACE = "sanctum-grading"
 
+// Pinecone limits an upsert request to 2MB, which is a little over 300
+// vectors of text-embedding-3-small with short metadata. Cards with long
+// text have up to about 30KB of metadata per vector, so batches are capped
+// by estimated size as well.
+const (
+	UPSERT_BATCH_SIZE  = 100
+	UPSERT_BATCH_BYTES = 1_500_000
+)
+
+// vectorSize estimates a vector's size in an upsert request
+func vectorSize(vector *pinecone.Vector) int {
+	size := len(vector.Id)
+	if vector.Values != nil {
+		size += 4 * len(*vector.Values)
+	}
+	if vector.Metadata != nil {
+		size += proto.Size(vector.Metadata)
+	}
+	return size
+}
+
+// Fetched vectors come back with their values and metadata, and gRPC
+// responses are capped at 4MB, so a fetch asks for about as many vectors as
+// an upsert sends
+const FETCH_BATCH_SIZE = 100
+
+var ErrCardNotFound = errors.New("answer is unavailable, either vector with this id does not exist or this vector is in the process of being inserted")
+
+// Stored answer vectors only change when a card is upserted or removed, and
+// both invalidate the cache
+const CARD_CACHE_SIZE = 512
+
+var cardCache = NewLRU[*StoredCard](CARD_CACHE_SIZE)
+
+// instance is read without holding mu, which only serializes connecting
 var (
-	instance *PineconeClient
-	once     sync.Once
+	instance atomic.Pointer[PineconeClient]
 	mu       sync.Mutex
 )
 
+// AddCards embeds every accepted answer and the question of every card,
+// batching the embedding requests, and upserts a vector for each in chunks
+// of UPSERT_BATCH_SIZE. The primary answer's vector ID
+// is the card's UUID; the others are linked to the card through
+// AnswerVectorId and PatternVectorId.
 func (pc *PineconeClient) AddCards(cards []Flashcard) (bool, error) {
-	matches := []string{}
-	for _, card := range cards {
-		matches = append(matches, card.Match)
+	// index is the answer's position in card.Answers(), or -1 for the pattern
+	type textRef struct {
+		card  int
+		index int
+	}
+
+	texts := []string{}
+	refs := []textRef{}
+	for i, card := range cards {
+		for j, answer := range card.Answers() {
+			texts = append(texts, answer)
+			refs = append(refs, textRef{card: i, index: j})
+		}
+
+		texts = append(texts, card.Pattern)
+		refs = append(refs, textRef{card: i, index: -1})
 	}
 
-	embeddings, err := MakeOpenAIEmbedRequest(matches)
+	embeddings, err := GetEmbedCache().Embed(texts)
 	if err != nil {
-		return false, fmt.Errorf("error making OpenAI Embed request: %v", err)
+		return false, fmt.Errorf("error making OpenAI Embed request: %w", err)
 	}
 
 	vectors := []*pinecone.Vector{}
-	for i, embedding := range *embeddings {
+	for i, embedding := range embeddings {
+		card := cards[refs[i].card]
+
+		id := PatternVectorId(card.Uuid)
+		if refs[i].index >= 0 {
+			id = AnswerVectorId(card.Uuid, refs[i].index)
+		}
+
+		metadata, err := cardMetadata(card, refs[i].index, texts[i])
+		if err != nil {
+			return false, err
+		}
+
 		vectors = append(vectors, &pinecone.Vector{
-			Id:     cards[i].Uuid,
-			Values: &embedding.Embedding,
+			Id:       id,
+			Values:   &embedding,
+			Metadata: metadata,
 		})
 	}
 
-	n, err := pc.Index.UpsertVectors(pc.Ctx, vectors)
-	if err != nil {
-		return false, err
+	var n uint32
+	for start, end := 0, 0; start < len(vectors); start = end {
+		size := 0
+		for end = start; end < len(vectors) && end-start < UPSERT_BATCH_SIZE; end += 1 {
+			size += vectorSize(vectors[end])
+			if size > UPSERT_BATCH_BYTES && end > start {
+				break
+			}
+		}
+		batch := vectors[start:end]
+
+		err = pc.withRetry(func(ctx context.Context) error {
+			upserted, err := pc.Index.UpsertVectors(ctx, batch)
+			if err == nil {
+				n += upserted
+			}
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
 	}
 	log.Printf("Vectors Upserted: %v", n)
 
+	for _, card := range cards {
+		cardCache.Remove(card.Uuid)
+	}
+
 	return true, nil
 }
 
+// RemoveCard deletes all of the card's vectors; IDs that don't exist are
+// ignored by Pinecone
 func (pc *PineconeClient) RemoveCard(cardId string) (bool, error) {
-	err := pc.Index.DeleteVectorsById(pc.Ctx, []string{cardId})
+	cardCache.Remove(cardId)
+
+	ids := append(AnswerVectorIds(cardId), PatternVectorId(cardId))
+	err := pc.withRetry(func(ctx context.Context) error {
+		return pc.Index.DeleteVectorsById(ctx, ids)
+	})
+
+	// Evicted again, since a fetch during the delete can cache it afresh
+	cardCache.Remove(cardId)
+
 	if err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
+// cardMetadata is stored alongside each of a card's vectors so the card's text
+// can be recovered from Pinecone, e.g. for judge grading, and so queries can
+// filter by owner and deck. answerIndex is -1 for the pattern vector.
+func cardMetadata(card Flashcard, answerIndex int, text string) (*pinecone.Metadata, error) {
+	accepted := []any{}
+	for _, answer := range card.Accepted {
+		accepted = append(accepted, answer)
+	}
+
+	options := []any{}
+	for _, option := range card.Options {
+		options = append(options, option)
+	}
+
+	tags := []any{}
+	for _, tag := range card.Tags {
+		tags = append(tags, tag)
+	}
+
+	templates := []any{}
+	for _, template := range card.Templates {
+		templates = append(templates, template)
+	}
+
+	field := "answer"
+	if answerIndex < 0 {
+		field = "pattern"
+	}
+
+	fields := map[string]any{
+		"card":        card.Uuid,
+		"type":        string(card.Type),
+		"clozeText":   card.Text,
+		"cloze":       card.Cloze,
+		"parent":      card.Parent,
+		"owner":       card.Owner,
+		"deck":        card.Deck,
+		"pattern":     card.Pattern,
+		"match":       card.Match,
+		"accepted":    accepted,
+		"options":     options,
+		"tags":        tags,
+		"difficulty":  string(card.Difficulty),
+		"source":      card.Source,
+		"notes":       card.Notes,
+		"created":     card.Created,
+		"document":    card.Document,
+		"chunk":       card.Chunk,
+		"templates":   templates,
+		"subtopic":    card.Subtopic,
+		"field":       field,
+		"text":        text,
+		"answerIndex": answerIndex,
+	}
+
+	if card.History != nil {
+		fields["reviews"] = card.History.Reviews
+		fields["lapses"] = card.History.Lapses
+		fields["interval"] = card.History.Interval
+		fields["ease"] = card.History.Ease
+		fields["lastReview"] = card.History.LastReview
+	}
+
+	metadata, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, fmt.Errorf("error building vector metadata: %v", err)
+	}
+
+	return metadata, nil
+}
+
+// cardFromMetadata rebuilds a card from the metadata on any of its vectors
+func cardFromMetadata(cardId string, metadata *pinecone.Metadata) Flashcard {
+	card := Flashcard{Uuid: cardId}
+	if metadata == nil {
+		return card
+	}
+
+	fields := metadata.AsMap()
+	card.Pattern, _ = fields["pattern"].(string)
+	card.Match, _ = fields["match"].(string)
+	card.Owner, _ = fields["owner"].(string)
+	card.Deck, _ = fields["deck"].(string)
+
+	cardType, _ := fields["type"].(string)
+	card.Type = CardType(cardType)
+	card.Text, _ = fields["clozeText"].(string)
+	card.Parent, _ = fields["parent"].(string)
+	if cloze, ok := fields["cloze"].(float64); ok {
+		card.Cloze = int(cloze)
+	}
+
+	accepted, _ := fields["accepted"].([]any)
+	for _, answer := range accepted {
+		if text, ok := answer.(string); ok {
+			card.Accepted = append(card.Accepted, text)
+		}
+	}
+
+	difficulty, _ := fields["difficulty"].(string)
+	card.Difficulty = Difficulty(difficulty)
+	card.Source, _ = fields["source"].(string)
+	card.Notes, _ = fields["notes"].(string)
+	if created, ok := fields["created"].(float64); ok {
+		card.Created = int64(created)
+	}
+	card.Document, _ = fields["document"].(string)
+	templates, _ := fields["templates"].([]any)
+	for _, template := range templates {
+		if id, ok := template.(string); ok {
+			card.Templates = append(card.Templates, id)
+		}
+	}
+	// Cards generated before every template was recorded only have the
+	// system prompt's
+	if template, ok := fields["template"].(string); ok && template != "" && len(card.Templates) == 0 {
+		card.Templates = []string{template}
+	}
+	card.Subtopic, _ = fields["subtopic"].(string)
+	if chunk, ok := fields["chunk"].(float64); ok {
+		card.Chunk = int(chunk)
+	}
+
+	if reviews, ok := fields["reviews"].(float64); ok {
+		card.History = &ReviewHistory{Reviews: int(reviews)}
+		if lapses, ok := fields["lapses"].(float64); ok {
+			card.History.Lapses = int(lapses)
+		}
+		if interval, ok := fields["interval"].(float64); ok {
+			card.History.Interval = int(interval)
+		}
+		if ease, ok := fields["ease"].(float64); ok {
+			card.History.Ease = float32(ease)
+		}
+		if lastReview, ok := fields["lastReview"].(float64); ok {
+			card.History.LastReview = int64(lastReview)
+		}
+	}
+
+	tags, _ := fields["tags"].([]any)
+	for _, tag := range tags {
+		if text, ok := tag.(string); ok {
+			card.Tags = append(card.Tags, text)
+		}
+	}
+
+	options, _ := fields["options"].([]any)
+	for _, option := range options {
+		if text, ok := option.(string); ok {
+			card.Options = append(card.Options, text)
+		}
+	}
+
+	return card
+}
+
 func (pc *PineconeClient) FetchAnswer(cardId string) (*[]float32, error) {
-	var answerEmbed *[]float32
+	card, err := pc.FetchCard(cardId)
+	if err != nil {
+		return nil, err
+	}
+
+	return card.Embedding, nil
+}
+
+// FetchCard returns the card's answer vectors along with whatever card text
+// was saved in their metadata. Cards indexed before metadata was stored come
+// back with an empty Pattern and Match.
+func (pc *PineconeClient) FetchCard(cardId string) (*StoredCard, error) {
+	cards, err := pc.FetchCards([]string{cardId})
+	if err != nil {
+		return nil, err
+	}
+
+	card, ok := cards[cardId]
+	if !ok {
+		return nil, ErrCardNotFound
+	}
+
+	return card, nil
+}
 
-	vectors, err := pc.Index.FetchVectors(pc.Ctx, []string{cardId})
+// FetchCards fetches every answer vector of every card, in as few calls as
+// FETCH_BATCH_SIZE allows, skipping cards already in cardCache. Cards that
+// don't exist are left out of the result.
+func (pc *PineconeClient) FetchCards(cardIds []string) (map[string]*StoredCard, error) {
+	cards := map[string]*StoredCard{}
+
+	ids := []string{}
+	missing := []string{}
+	seen := map[string]bool{}
+	for _, cardId := range cardIds {
+		if seen[cardId] {
+			continue
+		}
+		seen[cardId] = true
+
+		if card, ok := cardCache.Get(cardId); ok {
+			cards[cardId] = card
+			continue
+		}
+
+		missing = append(missing, cardId)
+		ids = append(ids, AnswerVectorIds(cardId)...)
+	}
+
+	if len(missing) == 0 {
+		return cards, nil
+	}
+
+	vectors, err := pc.fetchVectors(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cardId := range missing {
+		primary, ok := vectors[cardId]
+		if !ok || primary == nil {
+			continue
+		}
+
+		card := &StoredCard{
+			Card:      cardFromMetadata(cardId, primary.Metadata),
+			Embedding: primary.Values,
+		}
+
+		answers := card.Card.Answers()
+		for i, id := range AnswerVectorIds(cardId) {
+			vector, ok := vectors[id]
+			if !ok || vector == nil {
+				continue
+			}
+
+			answer := AnswerEmbedding{Index: i, Embedding: vector.Values}
+			if i < len(answers) {
+				answer.Answer = answers[i]
+			}
+			card.Answers = append(card.Answers, answer)
+		}
+
+		cards[cardId] = card
+		cardCache.Put(cardId, card)
+	}
+
+	return cards, nil
+}
+
+// fetchVectors fetches vectors by ID in chunks of FETCH_BATCH_SIZE, leaving
+// out the ones that don't exist
+func (pc *PineconeClient) fetchVectors(ids []string) (map[string]*pinecone.Vector, error) {
+	vectors := map[string]*pinecone.Vector{}
+	for start := 0; start < len(ids); start += FETCH_BATCH_SIZE {
+		batch := ids[start:min(start+FETCH_BATCH_SIZE, len(ids))]
+
+		var fetched *pinecone.FetchVectorsResponse
+		err := pc.withRetry(func(ctx context.Context) error {
+			var err error
+			fetched, err = pc.Index.FetchVectors(ctx, batch)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch vectors from pinecone: %v", err)
+		}
+
+		for id, vector := range fetched.Vectors {
+			vectors[id] = vector
+		}
+	}
+
+	return vectors, nil
+}
+
+// FetchPatternEmbeddings returns the question embedding of every card that's
+// been indexed, falling back to its primary answer's for cards indexed before
+// questions were embedded. Cards that don't exist, or are still waiting in the
+// outbox, are left out of the result.
+func (pc *PineconeClient) FetchPatternEmbeddings(cardIds []string) (map[string][]float32, error) {
+	ids := []string{}
+	for _, cardId := range cardIds {
+		ids = append(ids, PatternVectorId(cardId), cardId)
+	}
+
+	vectors, err := pc.fetchVectors(ids)
 	if err != nil {
-		return nil, fmt.Errorf("unable to fetch vectors from pinecone: %v", err)
+		return nil, err
 	}
 
-	if len(vectors.Vectors) == 0 {
-		return nil, fmt.Errorf("answer is unavailable, either vector with this id does not exist or this vector is in the process of being inserted")
+	embeddings := map[string][]float32{}
+	for _, cardId := range cardIds {
+		for _, id := range []string{PatternVectorId(cardId), cardId} {
+			if vector, ok := vectors[id]; ok && vector != nil && vector.Values != nil {
+				embeddings[cardId] = *vector.Values
+				break
+			}
+		}
 	}
 
-	answerEmbed = vectors.Vectors[cardId].Values
+	return embeddings, nil
+}
 
-	return answerEmbed, nil
+// withRetry runs an index operation under DefaultRetryPolicy, retrying only
+// the gRPC codes that indicate a transient failure
+func (pc *PineconeClient) withRetry(fn func(ctx context.Context) error) error {
+	return DefaultRetryPolicy.Do(pc.Ctx, func(ctx context.Context) error {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+
+		switch status.Code(err) {
+		case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted, codes.Internal:
+			return &RetryableError{Err: err}
+		}
+
+		return err
+	})
 }
 
 func (pc *PineconeClient) IndexMetrics() (IndexMetrics, error) {
@@ -137,25 +541,23 @@ func InitPineconeClient() (*PineconeClient, error) {
 }
 
 func GetPineconeClient() (*PineconeClient, error) {
-	if instance != nil {
-		return instance, nil
+	if pc := instance.Load(); pc != nil {
+		return pc, nil
 	}
 
 	mu.Lock()
 	defer mu.Unlock()
 
-	if instance != nil {
-		return instance, nil
+	if pc := instance.Load(); pc != nil {
+		return pc, nil
 	}
 
-	var err error
-	once.Do(func() {
-		instance, err = InitPineconeClient()
-	})
-
+	// Not a sync.Once: a failed connection should be retried on the next call
+	pc, err := InitPineconeClient()
 	if err != nil {
 		return nil, err
 	}
 
-	return instance, nil
+	instance.Store(pc)
+	return pc, nil
 }
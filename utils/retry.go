@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy describes how calls to upstream services (OpenAI, Pinecone) are
+// retried. Timeout applies to each attempt, not to the call as a whole.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Timeout     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+	Timeout:     60 * time.Second,
+}
+
+// StreamRetryPolicy is for streamed responses. The client timeout covers
+// reading the body, which for a streamed completion takes much longer.
+var StreamRetryPolicy = RetryPolicy{
+	MaxAttempts: DefaultRetryPolicy.MaxAttempts,
+	BaseDelay:   DefaultRetryPolicy.BaseDelay,
+	MaxDelay:    DefaultRetryPolicy.MaxDelay,
+	Timeout:     5 * time.Minute,
+}
+
+// RetryableError marks a failure as transient. RetryAfter is the delay the
+// upstream asked for, if any.
+type RetryableError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is an upstream's response with a status that isn't retried
+// or has run out of retries
+type StatusError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// backoff returns a full-jitter exponential delay for the given attempt (0-based)
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << attempt
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// Do runs fn until it succeeds, returns a non-retryable error, asks to be
+// retried after more than p.MaxDelay, or the policy runs out of attempts.
+// Each attempt gets its own context bounded by p.Timeout.
+func (p RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; attempt < p.MaxAttempts; attempt += 1 {
+		attemptCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+		err = fn(attemptCtx)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		var retryable *RetryableError
+		if !errors.As(err, &retryable) || attempt == p.MaxAttempts-1 {
+			return err
+		}
+
+		// An upstream asking us to wait longer than MaxDelay won't be ready
+		// within this call, and waiting would stall callers on a background
+		// context like the outbox for as long as it asked
+		if retryable.RetryAfter > p.MaxDelay {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		if retryable.RetryAfter > delay {
+			delay = retryable.RetryAfter
+		}
+
+		log.Printf("Attempt %d of %d failed, retrying in %v: %v", attempt+1, p.MaxAttempts, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// DoRequest sends an HTTP request under the policy. The body is buffered so it
+// can be replayed. 429s, 5xxs and network errors are retried; any other
+// non-200 status is returned as an error immediately.
+func (p RetryPolicy) DoRequest(ctx context.Context, method string, url string, header http.Header, body []byte) (*http.Response, error) {
+	client := &http.Client{Timeout: p.Timeout}
+
+	var res *http.Response
+	err := p.Do(ctx, func(_ context.Context) error {
+		// The client timeout bounds the attempt instead of attemptCtx, which
+		// would be cancelled before the caller gets to read the body
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("error creating request: %v", err)
+		}
+		req.Header = header.Clone()
+
+		r, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return &RetryableError{Err: fmt.Errorf("error making request: %v", err)}
+		}
+
+		if r.StatusCode == http.StatusOK {
+			res = r
+			return nil
+		}
+
+		detail, _ := io.ReadAll(io.LimitReader(r.Body, 512))
+		r.Body.Close()
+
+		statusErr := &StatusError{
+			StatusCode: r.StatusCode,
+			Err:        fmt.Errorf("api request failed with status: %v: %s", r.StatusCode, bytes.TrimSpace(detail)),
+		}
+		if r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500 {
+			return &RetryableError{
+				Err:        statusErr,
+				RetryAfter: parseRetryAfter(r.Header.Get("Retry-After")),
+			}
+		}
+
+		return statusErr
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// parseRetryAfter handles both forms of the header: delay-seconds and an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/pinecone-io/go-pinecone/v3/pinecone"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const DEFAULT_SEARCH_LIMIT = 10
+const MAX_SEARCH_LIMIT = 50
+
+// Each card has several vectors (question plus accepted answers), so queries
+// over-fetch by this factor before collapsing matches down to cards
+const SEARCH_OVERFETCH = 4
+
+// CardFilter narrows a query to one deck, cards carrying all of Tags, one
+// difficulty or one source. Zero fields don't filter.
+type CardFilter struct {
+	Deck       string
+	Tags       []string
+	Difficulty Difficulty
+	Source     string
+}
+
+// ownerFilter restricts a query to one user's cards, and further by filter
+func ownerFilter(owner string, filter CardFilter) (*pinecone.MetadataFilter, error) {
+	conditions := []any{
+		map[string]any{"owner": map[string]any{"$eq": owner}},
+	}
+	if filter.Deck != "" {
+		conditions = append(conditions, map[string]any{"deck": map[string]any{"$eq": filter.Deck}})
+	}
+	for _, tag := range NormalizeTags(filter.Tags) {
+		// $in on a list field matches when any element is in the given list
+		conditions = append(conditions, map[string]any{"tags": map[string]any{"$in": []any{tag}}})
+	}
+	if filter.Difficulty != "" {
+		conditions = append(conditions, map[string]any{"difficulty": map[string]any{"$eq": string(filter.Difficulty)}})
+	}
+	if filter.Source != "" {
+		conditions = append(conditions, map[string]any{"source": map[string]any{"$eq": filter.Source}})
+	}
+
+	metadataFilter, err := structpb.NewStruct(map[string]any{"$and": conditions})
+	if err != nil {
+		return nil, fmt.Errorf("error building metadata filter: %v", err)
+	}
+
+	return metadataFilter, nil
+}
+
+// queryCards runs a nearest-neighbour query and collapses the matching
+// vectors into cards, each scored by its best-matching vector. Cards in
+// exclude are dropped.
+func (pc *PineconeClient) queryCards(vector []float32, filter *pinecone.MetadataFilter, limit int, exclude string) ([]SearchResult, error) {
+	var res *pinecone.QueryVectorsResponse
+	err := pc.withRetry(func(ctx context.Context) error {
+		var err error
+		res, err = pc.Index.QueryByVectorValues(ctx, &pinecone.QueryByVectorValuesRequest{
+			Vector:          vector,
+			TopK:            uint32(limit * SEARCH_OVERFETCH),
+			MetadataFilter:  filter,
+			IncludeMetadata: true,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to query pinecone: %v", err)
+	}
+
+	best := map[string]*SearchResult{}
+	for _, match := range res.Matches {
+		if match.Vector == nil || match.Vector.Metadata == nil {
+			continue
+		}
+
+		fields := match.Vector.Metadata.AsMap()
+		cardId, _ := fields["card"].(string)
+		if cardId == "" || cardId == exclude {
+			continue
+		}
+
+		if existing, ok := best[cardId]; ok && existing.Score >= match.Score {
+			continue
+		}
+
+		result := &SearchResult{
+			Card:  cardFromMetadata(cardId, match.Vector.Metadata),
+			Score: match.Score,
+		}
+		result.MatchedField, _ = fields["field"].(string)
+		result.MatchedText, _ = fields["text"].(string)
+
+		best[cardId] = result
+	}
+
+	results := []SearchResult{}
+	for _, result := range best {
+		results = append(results, *result)
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// SearchCards embeds query and returns owner's closest cards that pass
+// filter, matching on both questions and answers
+func (pc *PineconeClient) SearchCards(query string, owner string, cardFilter CardFilter, limit int) ([]SearchResult, error) {
+	embeddings, err := GetEmbedCache().Embed([]string{query})
+	if err != nil {
+		return nil, fmt.Errorf("unable to embed query: %v", err)
+	}
+
+	filter, err := ownerFilter(owner, cardFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	return pc.queryCards(embeddings[0], filter, limit, "")
+}
+
+// RelatedCards returns owner's cards closest to the given card, using its
+// stored primary answer vector as the query
+func (pc *PineconeClient) RelatedCards(cardId string, owner string, cardFilter CardFilter, limit int) (*StoredCard, []SearchResult, error) {
+	card, err := pc.FetchCard(cardId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Other users' cards look the same as missing ones
+	if card.Card.Owner != owner {
+		return nil, nil, ErrCardNotFound
+	}
+
+	filter, err := ownerFilter(owner, cardFilter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results, err := pc.queryCards(*card.Embedding, filter, limit, cardId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return card, results, nil
+}
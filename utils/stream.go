@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// MakeOpenAIChatStreamRequest requests a streamed completion and sends each
+// content delta on the returned channel, closing it when the completion ends.
+// The error channel receives at most one value. Only the initial request is
+// retried; a stream that breaks partway is reported as an error, since
+// replaying it would duplicate output the caller has already seen.
+func MakeOpenAIChatStreamRequest(ctx context.Context, messages []Message, responseFormat *ResponseFormat) (<-chan string, <-chan error) {
+	deltas := make(chan string)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(deltas)
+		defer close(errc)
+
+		reqBody := ChatRequest{
+			Model:          "gpt-4o",
+			Messages:       messages,
+			ResponseFormat: responseFormat,
+			Stream:         true,
+		}
+
+		res, err := makeOpenAIRequest(ctx, StreamRetryPolicy, reqBody, CHAT_ENDPOINT)
+		if err != nil {
+			errc <- fmt.Errorf("error making request to OpenAI Chat endpoint: %v", err)
+			return
+		}
+
+		defer res.Body.Close()
+
+		scanner := bufio.NewScanner(res.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+
+			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			if data == "[DONE]" {
+				return
+			}
+
+			var chunk ChatStreamChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				errc <- fmt.Errorf("error parsing stream chunk: %v", err)
+				return
+			}
+
+			for _, choice := range chunk.Choices {
+				if choice.Delta.Content == "" {
+					continue
+				}
+
+				select {
+				case deltas <- choice.Delta.Content:
+				case <-ctx.Done():
+					errc <- ctx.Err()
+					return
+				}
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			errc <- fmt.Errorf("error reading stream: %v", err)
+			return
+		}
+
+		errc <- fmt.Errorf("stream ended before completion")
+	}()
+
+	return deltas, errc
+}
+
+// MakeOpenAIFlashcardStreamRequest streams a completion using the flashcard
+// schema for cardType and sends each card as soon as its JSON object is
+// complete. Cloze cards arrive as unexpanded notes with only Text set, and
+// multiple-choice cards with unfiltered Distractors and no Options yet.
+func MakeOpenAIFlashcardStreamRequest(ctx context.Context, messages []Message, cardType CardType) (<-chan Flashcard, <-chan error) {
+	cards := make(chan Flashcard)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(cards)
+		defer close(errc)
+
+		deltas, deltaErrc := MakeOpenAIChatStreamRequest(ctx, messages, GetFlashcardSchema(cardType))
+
+		parser := CardStreamParser{}
+		for delta := range deltas {
+			for _, raw := range parser.Write(delta) {
+				var card Flashcard
+				if err := json.Unmarshal(raw, &card); err != nil {
+					errc <- fmt.Errorf("error parsing streamed card: %v", err)
+					return
+				}
+				if cardType == CardCloze || cardType == CardMultipleChoice {
+					card.Type = cardType
+				}
+
+				select {
+				case cards <- card:
+				case <-ctx.Done():
+					errc <- ctx.Err()
+					return
+				}
+			}
+		}
+
+		if err := <-deltaErrc; err != nil {
+			errc <- err
+		}
+	}()
+
+	return cards, errc
+}
+
+// CardStreamParser incrementally scans the {"cards": [...]} document the
+// flashcard schema produces and picks out each card object as it closes.
+// Any schema shaped as one object holding an array of objects works the
+// same way. It only tracks nesting and string state, so it never has to
+// re-parse the whole buffer.
+type CardStreamParser struct {
+	buf      []byte
+	pos      int
+	depth    int
+	inString bool
+	escaped  bool
+	start    int
+}
+
+// Write appends a chunk of the document and returns the raw JSON of every
+// card that was completed by it
+func (p *CardStreamParser) Write(chunk string) [][]byte {
+	p.buf = append(p.buf, chunk...)
+
+	var complete [][]byte
+	for ; p.pos < len(p.buf); p.pos += 1 {
+		c := p.buf[p.pos]
+
+		if p.inString {
+			switch {
+			case p.escaped:
+				p.escaped = false
+			case c == '\\':
+				p.escaped = true
+			case c == '"':
+				p.inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			p.inString = true
+		case '{', '[':
+			p.depth += 1
+			// The outer object is depth 1 and the cards array depth 2
+			if c == '{' && p.depth == 3 {
+				p.start = p.pos
+			}
+		case '}', ']':
+			if c == '}' && p.depth == 3 {
+				card := make([]byte, p.pos+1-p.start)
+				copy(card, p.buf[p.start:p.pos+1])
+				complete = append(complete, card)
+			}
+			p.depth -= 1
+		}
+	}
+
+	return complete
+}
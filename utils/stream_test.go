@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCardStreamParserWrite(t *testing.T) {
+	document := `{"cards": [{"pattern": "a {brace} and \"quote\"", "match": "b"}, {"pattern": "[x]", "match": "\\", "tags": ["t"]}]}`
+	want := []string{
+		`{"pattern": "a {brace} and \"quote\"", "match": "b"}`,
+		`{"pattern": "[x]", "match": "\\", "tags": ["t"]}`,
+	}
+
+	tests := []struct {
+		name      string
+		chunkSize int
+	}{
+		{"whole document", len(document)},
+		{"one byte at a time", 1},
+		{"uneven chunks", 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var parser CardStreamParser
+
+			got := []string{}
+			for start := 0; start < len(document); start += tt.chunkSize {
+				for _, card := range parser.Write(document[start:min(start+tt.chunkSize, len(document))]) {
+					got = append(got, string(card))
+				}
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("cards = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCardStreamParserIncomplete(t *testing.T) {
+	var parser CardStreamParser
+
+	if cards := parser.Write(`{"cards": [{"pattern": "a", "match": "b"}, {"pattern": "c`); len(cards) != 1 {
+		t.Fatalf("got %d cards from the first chunk, want 1", len(cards))
+	}
+	if cards := parser.Write(`", "match": "d"`); len(cards) != 0 {
+		t.Fatalf("got %d cards before the second closed, want 0", len(cards))
+	}
+	if cards := parser.Write(`}]}`); len(cards) != 1 || string(cards[0]) != `{"pattern": "c", "match": "d"}` {
+		t.Fatalf("got %q once the second closed", cards)
+	}
+}
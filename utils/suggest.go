@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type VariantKind string
+
+const (
+	VariantBalanced VariantKind = "balanced"
+	VariantNarrower VariantKind = "narrower"
+	VariantBroader  VariantKind = "broader"
+	VariantExam     VariantKind = "exam"
+)
+
+// Estimates are the model's guess, so they're clamped to something a single
+// deck generation could plausibly produce
+const MAX_ESTIMATED_CARDS = 200
+
+// PromptVariant is one suggested rewrite of a study prompt
+type PromptVariant struct {
+	Kind           VariantKind `json:"kind"`
+	Prompt         string      `json:"prompt"`
+	Subtopics      []string    `json:"subtopics"`
+	EstimatedCards int         `json:"estimatedCards"`
+}
+
+func GetPromptVariantsSchema() *ResponseFormat {
+	return &ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: JSONSchemaSpec{
+			Name: "prompt_variants",
+			Schema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"variants": map[string]any{
+						"type": "array",
+						"items": map[string]any{
+							"type": "object",
+							"properties": map[string]any{
+								"kind": map[string]any{
+									"type": "string",
+									"enum": []string{string(VariantBalanced), string(VariantNarrower), string(VariantBroader), string(VariantExam)},
+								},
+								"prompt": map[string]any{"type": "string"},
+								"subtopics": map[string]any{
+									"type":  "array",
+									"items": map[string]any{"type": "string"},
+								},
+								"estimatedCards": map[string]any{"type": "integer"},
+							},
+							"required":             []string{"kind", "prompt", "subtopics", "estimatedCards"},
+							"additionalProperties": false,
+						},
+					},
+				},
+				"required":             []string{"variants"},
+				"additionalProperties": false,
+			},
+		},
+	}
+}
+
+func (variant PromptVariant) normalized() PromptVariant {
+	variant.Prompt = strings.TrimSpace(variant.Prompt)
+	variant.EstimatedCards = max(1, min(MAX_ESTIMATED_CARDS, variant.EstimatedCards))
+
+	subtopics := []string{}
+	for _, subtopic := range variant.Subtopics {
+		if subtopic = strings.TrimSpace(subtopic); subtopic != "" {
+			subtopics = append(subtopics, subtopic)
+		}
+	}
+	variant.Subtopics = subtopics
+
+	return variant
+}
+
+// SuggestPromptVariants asks the chat model for the prompt variants
+// described by messages
+func SuggestPromptVariants(messages []Message) ([]PromptVariant, error) {
+	response, err := MakeOpenAIChatRequest(messages, GetPromptVariantsSchema())
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Variants []PromptVariant `json:"variants"`
+	}
+	if err := json.Unmarshal([]byte(response), &parsed); err != nil {
+		return nil, fmt.Errorf("error parsing prompt variants: %v", err)
+	}
+
+	variants := []PromptVariant{}
+	for _, variant := range parsed.Variants {
+		if variant = variant.normalized(); variant.Prompt != "" {
+			variants = append(variants, variant)
+		}
+	}
+
+	return variants, nil
+}
+
+// StreamPromptVariants is SuggestPromptVariants streamed, sending each
+// variant as soon as its JSON object is complete
+func StreamPromptVariants(ctx context.Context, messages []Message) (<-chan PromptVariant, <-chan error) {
+	variants := make(chan PromptVariant)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(variants)
+		defer close(errc)
+
+		deltas, deltaErrc := MakeOpenAIChatStreamRequest(ctx, messages, GetPromptVariantsSchema())
+
+		parser := CardStreamParser{}
+		for delta := range deltas {
+			for _, raw := range parser.Write(delta) {
+				var variant PromptVariant
+				if err := json.Unmarshal(raw, &variant); err != nil {
+					errc <- fmt.Errorf("error parsing streamed prompt variant: %v", err)
+					return
+				}
+
+				if variant = variant.normalized(); variant.Prompt == "" {
+					continue
+				}
+
+				select {
+				case variants <- variant:
+				case <-ctx.Done():
+					errc <- ctx.Err()
+					return
+				}
+			}
+		}
+
+		if err := <-deltaErrc; err != nil {
+			errc <- err
+		}
+	}()
+
+	return variants, errc
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const MAX_IMPORT_ROWS = 20000
+
+const (
+	ROW_IMPORTED = "imported"
+	ROW_REJECTED = "rejected"
+)
+
+// Header names recognised for each card field when no mapping is given,
+// compared case-insensitively. The first set matches EXPORT_COLUMNS.
+var COLUMN_ALIASES = map[string][]string{
+	"pattern":    {"pattern", "question", "front", "prompt", "q"},
+	"match":      {"match", "answer", "back", "a"},
+	"accepted":   {"accepted", "alternatives", "also accepted"},
+	"tags":       {"tags", "tag"},
+	"difficulty": {"difficulty"},
+	"notes":      {"notes", "note", "extra"},
+}
+
+// ImportRow reports what happened to one row of a CSV/TSV import. Row is
+// the line of the file the row starts on, so the header is row 1 and cells
+// with line breaks don't throw the numbering off.
+type ImportRow struct {
+	Row    int        `json:"row"`
+	Status string     `json:"status"`
+	Uuid   string     `json:"uuid,omitempty"`
+	Error  string     `json:"error,omitempty"`
+	Card   *Flashcard `json:"-"`
+}
+
+// splitList splits a list cell on semicolons, the LIST_SEPARATOR exports
+// join lists with. Commas are left alone, since answers like "1,000" or
+// "Washington, D.C." have them.
+func splitList(cell string) []string {
+	items := []string{}
+	for _, item := range strings.Split(cell, strings.TrimSpace(LIST_SEPARATOR)) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// resolveColumns finds the column index of each card field, from mapping
+// (card field to header name) where given and COLUMN_ALIASES otherwise
+func resolveColumns(header []string, mapping map[string]string) (map[string]int, error) {
+	positions := map[string]int{}
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	for field := range mapping {
+		if _, ok := COLUMN_ALIASES[field]; !ok {
+			return nil, fmt.Errorf("unknown card field %q in mapping", field)
+		}
+	}
+
+	columns := map[string]int{}
+	for field, aliases := range COLUMN_ALIASES {
+		if name, ok := mapping[field]; ok {
+			position, ok := positions[strings.ToLower(strings.TrimSpace(name))]
+			if !ok {
+				return nil, fmt.Errorf("mapped column %q for %s is not in the header", name, field)
+			}
+			columns[field] = position
+			continue
+		}
+
+		for _, alias := range aliases {
+			if position, ok := positions[alias]; ok {
+				columns[field] = position
+				break
+			}
+		}
+	}
+
+	for _, field := range []string{"pattern", "match"} {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("no column for %s; name one in the mapping", field)
+		}
+	}
+
+	return columns, nil
+}
+
+// ParseCardTable reads a CSV or TSV with a header row into basic cards, one
+// per row. Every row is validated and either carries its Card or says why
+// it was rejected; the error return is only for a file that can't be read
+// at all.
+func ParseCardTable(data []byte, delimiter rune, mapping map[string]string) ([]ImportRow, error) {
+	// Spreadsheets often save UTF-8 with a byte order mark
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	if delimiter == '\t' {
+		// TSV exports from other tools rarely quote consistently
+		reader.LazyQuotes = true
+	}
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+
+	columns, err := resolveColumns(header, mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []ImportRow{}
+	seen := map[string]int{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		row := ImportRow{Status: ROW_REJECTED}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			// A malformed row can't be trusted, but the rest of the file can
+			row.Row = parseErr.StartLine
+			row.Error = parseErr.Err.Error()
+			rows = append(rows, row)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading file: %v", err)
+		}
+
+		row.Row, _ = reader.FieldPos(0)
+
+		if len(rows) == MAX_IMPORT_ROWS {
+			return nil, fmt.Errorf("file has more than %d rows", MAX_IMPORT_ROWS)
+		}
+
+		cell := func(field string) string {
+			if position, ok := columns[field]; ok && position < len(record) {
+				return strings.TrimSpace(record[position])
+			}
+			return ""
+		}
+
+		card := Flashcard{
+			Pattern:    cell("pattern"),
+			Match:      cell("match"),
+			Accepted:   splitList(cell("accepted")),
+			Tags:       splitList(cell("tags")),
+			Difficulty: Difficulty(strings.ToLower(cell("difficulty"))),
+			Notes:      cell("notes"),
+		}
+
+		key := strings.ToLower(card.Pattern)
+		invalid := card.Validate()
+		switch {
+		case card.Pattern == "" && card.Match == "" && strings.TrimSpace(strings.Join(record, "")) == "":
+			// Blank rows are common at the end of spreadsheet exports
+			continue
+		case card.Pattern == "":
+			row.Error = "pattern is empty"
+		case card.Match == "":
+			row.Error = "match is empty"
+		case !card.Difficulty.Valid():
+			row.Error = fmt.Sprintf("difficulty %q must be easy, medium or hard", card.Difficulty)
+		case len(card.Accepted) >= MAX_ACCEPTED_ANSWERS:
+			row.Error = fmt.Sprintf("at most %d accepted answers are allowed", MAX_ACCEPTED_ANSWERS-1)
+		case invalid != nil:
+			row.Error = invalid.Error()
+		case seen[key] != 0:
+			row.Error = fmt.Sprintf("duplicate of row %d", seen[key])
+		default:
+			seen[key] = row.Row
+			row.Status = ROW_IMPORTED
+			row.Card = &card
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		cell string
+		want []string
+	}{
+		{"", []string{}},
+		{"Paris", []string{"Paris"}},
+		{"Soviet Union; USSR", []string{"Soviet Union", "USSR"}},
+		{"a;b ; ;c;", []string{"a", "b", "c"}},
+		{"Washington, D.C.", []string{"Washington, D.C."}},
+		{"1,000; one thousand", []string{"1,000", "one thousand"}},
+	}
+
+	for _, tt := range tests {
+		if got := splitList(tt.cell); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitList(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+	}
+}
+
+func TestParseCardTable(t *testing.T) {
+	type row struct {
+		Row    int
+		Status string
+		Error  string
+		Card   *Flashcard
+	}
+
+	tests := []struct {
+		name      string
+		data      string
+		delimiter rune
+		mapping   map[string]string
+		rows      []row
+		err       bool
+	}{
+		{
+			name: "header aliases and list cells",
+			data: "Question,Answer,Also Accepted,Tags,Difficulty,Notes\n" +
+				"Capital of the US?,\"Washington, D.C.\",DC; Washington,Geography; US,Easy,\n",
+			delimiter: ',',
+			rows: []row{{Row: 2, Status: ROW_IMPORTED, Card: &Flashcard{
+				Pattern:    "Capital of the US?",
+				Match:      "Washington, D.C.",
+				Accepted:   []string{"DC", "Washington"},
+				Tags:       []string{"Geography", "US"},
+				Difficulty: DifficultyEasy,
+			}}},
+		},
+		{
+			name:      "tab separated with a byte order mark",
+			data:      "\xef\xbb\xbffront\tback\n2+2\t4\n",
+			delimiter: '\t',
+			rows:      []row{{Row: 2, Status: ROW_IMPORTED, Card: &Flashcard{Pattern: "2+2", Match: "4", Accepted: []string{}, Tags: []string{}}}},
+		},
+		{
+			name:      "mapping",
+			data:      "term,definition\nCell,Unit of life\n",
+			delimiter: ',',
+			mapping:   map[string]string{"pattern": "term", "match": "definition"},
+			rows:      []row{{Row: 2, Status: ROW_IMPORTED, Card: &Flashcard{Pattern: "Cell", Match: "Unit of life", Accepted: []string{}, Tags: []string{}}}},
+		},
+		{
+			name:      "rejected rows",
+			data:      "pattern,match,difficulty\n,4,\n2+2,,\n2+2,4,impossible\n2+2,4,\n2+2,four,\n,,\n",
+			delimiter: ',',
+			rows: []row{
+				{Row: 2, Status: ROW_REJECTED, Error: "pattern is empty"},
+				{Row: 3, Status: ROW_REJECTED, Error: "match is empty"},
+				{Row: 4, Status: ROW_REJECTED, Error: `difficulty "impossible" must be easy, medium or hard`},
+				{Row: 5, Status: ROW_IMPORTED, Card: &Flashcard{Pattern: "2+2", Match: "4", Accepted: []string{}, Tags: []string{}}},
+				{Row: 6, Status: ROW_REJECTED, Error: "duplicate of row 5"},
+			},
+		},
+		{
+			name:      "notes too long to store",
+			data:      "pattern,match,notes\n2+2,4," + strings.Repeat("x", MAX_NOTES_LENGTH+1) + "\n",
+			delimiter: ',',
+			rows:      []row{{Row: 2, Status: ROW_REJECTED, Error: "notes are 4001 bytes long, at most 4000 are allowed"}},
+		},
+		{
+			name:      "no match column",
+			data:      "pattern,other\n2+2,4\n",
+			delimiter: ',',
+			err:       true,
+		},
+		{
+			name:      "mapped column missing",
+			data:      "pattern,match\n2+2,4\n",
+			delimiter: ',',
+			mapping:   map[string]string{"match": "answer"},
+			err:       true,
+		},
+		{
+			name:      "empty file",
+			data:      "",
+			delimiter: ',',
+			err:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := ParseCardTable([]byte(tt.data), tt.delimiter, tt.mapping)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got rows %+v", rows)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := []row{}
+			for _, r := range rows {
+				got = append(got, row{Row: r.Row, Status: r.Status, Error: r.Error, Card: r.Card})
+			}
+			if !reflect.DeepEqual(got, tt.rows) {
+				t.Errorf("rows = %+v, want %+v", got, tt.rows)
+				for i := range got {
+					if got[i].Card != nil {
+						t.Logf("row %d card: %+v", got[i].Row, *got[i].Card)
+					}
+				}
+			}
+		})
+	}
+}
@@ -9,27 +9,142 @@ import (
 /*-----------------------------------------------------*/
 
 type DeckRequest struct {
-	Prompt string `json:"prompt"`
+	Prompt   string   `json:"prompt"`
+	CardType CardType `json:"cardType,omitempty"`
+
+	// Selects a version of the generation prompt templates, defaulting to
+	// the latest. v1 is the set from before decks were outlined.
+	PromptVersion string `json:"promptVersion,omitempty"`
+
+	// How many cards to aim for, defaulting to DEFAULT_DECK_SIZE
+	Size int `json:"size,omitempty"`
+
+	// Used as the deck's outline instead of generating one, such as the
+	// subtopics of a variant from /prompt-suggestion
+	Subtopics []string `json:"subtopics,omitempty"`
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// Multiple-choice cards list every choice, in display order, in Options.
+// Cloze cards keep the note's marked-up Text, which of its deletions they
+// blank out (Cloze) and the note they were expanded from (Parent); Pattern
+// and Match are filled in from those, so grading treats them like any card.
 type Flashcard struct {
-	Pattern string `json:"pattern"`
-	Match   string `json:"match"`
-	Uuid    string `json:"uuid"`
+	Type        CardType `json:"type,omitempty"`
+	Pattern     string   `json:"pattern"`
+	Match       string   `json:"match"`
+	Accepted    []string `json:"accepted,omitempty"`
+	Options     []string `json:"options,omitempty"`
+	Distractors []string `json:"distractors,omitempty"`
+	Text        string   `json:"text,omitempty"`
+	Cloze       int      `json:"cloze,omitempty"`
+	Parent      string   `json:"parent,omitempty"`
+	Uuid        string   `json:"uuid"`
+	Deck        string   `json:"deck,omitempty"`
+	Owner       string   `json:"owner,omitempty"`
+
+	Tags       []string   `json:"tags,omitempty"`
+	Difficulty Difficulty `json:"difficulty,omitempty"`
+	Source     string     `json:"source,omitempty"`
+	Notes      string     `json:"notes,omitempty"`
+
+	// Unix seconds, so it can be range-filtered in vector metadata
+	Created int64 `json:"created,omitempty"`
+
+	// Cards generated from an uploaded document record its name and the
+	// chunk, counting from 1, that the card was grounded in
+	Document string `json:"document,omitempty"`
+	Chunk    int    `json:"chunk,omitempty"`
+
+	// The prompt templates, as name@version, a generated card came from,
+	// its system prompt first
+	Templates []string `json:"templates,omitempty"`
+
+	// The subtopic of the deck's outline a generated card was written for
+	Subtopic string `json:"subtopic,omitempty"`
+
+	// Set on cards imported with their review history from another app
+	History *ReviewHistory `json:"history,omitempty"`
+}
+
+// FileImport reports what was imported from one file: the deck its cards
+// went into, how many there were and the lines that couldn't be parsed
+type FileImport struct {
+	File   string       `json:"file"`
+	Deck   string       `json:"deck,omitempty"`
+	Title  string       `json:"title,omitempty"`
+	Cards  int          `json:"cards"`
+	Errors []ParseError `json:"errors"`
 }
 
 type FlashcardDeck struct {
+	Id    string      `json:"id,omitempty"`
 	Cards []Flashcard `json:"cards"`
 	Title string      `json:"title"`
+	Owner string      `json:"owner,omitempty"`
+
+	// The subtopics the deck was generated from, or first had its coverage
+	// compared with, so later coverage reports compare it with the same ones
+	Outline []Subtopic `json:"outline,omitempty"`
+}
+
+type SearchResult struct {
+	Card         Flashcard `json:"card"`
+	Score        float32   `json:"score"`
+	MatchedField string    `json:"matchedField"`
+	MatchedText  string    `json:"matchedText"`
 }
 
 type GradeRequest struct {
-	Uuid   string `json:"uuid"`
-	Answer string `json:"answer"`
+	Uuid        string    `json:"uuid"`
+	Answer      string    `json:"answer"`
+	Deck        string    `json:"deck,omitempty"`
+	Feedback    bool      `json:"feedback,omitempty"`
+	Mode        GradeMode `json:"mode,omitempty"`
+	JudgeWeight *float32  `json:"judgeWeight,omitempty"`
+}
+
+type BatchGradeRequest struct {
+	Items []GradeRequest `json:"items"`
+}
+
+type BatchGradeItem struct {
+	Uuid   string       `json:"uuid"`
+	Status string       `json:"status"`
+	Result *GradeResult `json:"result,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+type GradeResult struct {
+	NumericGrade     float32        `json:"numericGrade"`
+	Mode             GradeMode      `json:"mode"`
+	CosineGrade      *float32       `json:"cosineGrade,omitempty"`
+	JudgeGrade       *float32       `json:"judgeGrade,omitempty"`
+	Verdict          Verdict        `json:"verdict,omitempty"`
+	Reasoning        string         `json:"reasoning,omitempty"`
+	MatchedAnswer    string         `json:"matchedAnswer,omitempty"`
+	MatchedIndex     int            `json:"matchedIndex"`
+	CalibratedGrade  *float32       `json:"calibratedGrade,omitempty"`
+	Passed           *bool          `json:"passed,omitempty"`
+	CalibrationScope string         `json:"calibrationScope,omitempty"`
+	Feedback         *GradeFeedback `json:"feedback,omitempty"`
+}
+
+type GradeFeedback struct {
+	Missing       []string `json:"missing"`
+	Incorrect     []string `json:"incorrect"`
+	CorrectAnswer string   `json:"correctAnswer"`
+	Accepted      []string `json:"accepted,omitempty"`
+	Explanation   string   `json:"explanation"`
+}
+
+type JudgeResult struct {
+	Score     float32 `json:"score"`
+	Verdict   Verdict `json:"verdict"`
+	Reasoning string  `json:"reasoning"`
 }
 
 /*-----------------------------------------------------*/
@@ -43,6 +158,18 @@ type PineconeClient struct {
 	Index  *pinecone.IndexConnection
 }
 
+type StoredCard struct {
+	Card      Flashcard
+	Embedding *[]float32
+	Answers   []AnswerEmbedding
+}
+
+type AnswerEmbedding struct {
+	Index     int
+	Answer    string
+	Embedding *[]float32
+}
+
 type IndexMetrics struct {
 	VectorCount int
 	Dimension   int
@@ -75,12 +202,22 @@ type ChatRequest struct {
 	Model          string          `json:"model"`
 	Messages       []Message       `json:"messages"`
 	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Stream         bool            `json:"stream,omitempty"`
 }
 
 type ChatResponse struct {
 	Choices []Choice `json:"choices"`
 }
 
+type ChatStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+}
+
 type EmbedRequest struct {
 	Input []string `json:"input"`
 	Model string   `json:"model"`